@@ -10,6 +10,7 @@ import (
     "fmt"
     "os"
     "bufio"
+    "context"
     "encoding/json"
     "strings"
     "io"
@@ -18,18 +19,61 @@ import (
     "strconv"
 )
 
+//Typed errors surfaced by Read/Stream/Results instead of os.Exit, so
+//JReader can be used as a library and not just as a standalone tool.
+var (
+    //ErrCollision is returned when a non-multi path is matched twice
+    //before the result it belongs to was complete (bad input order).
+    ErrCollision = errors.New("json_extractor: collision before result was full (bad order?)")
+    //ErrIncomplete is returned when the search area for a result object
+    //is left before all requested keys were found. With
+    //JReader.AllowIncomplete set, the partial result is returned instead.
+    ErrIncomplete = errors.New("json_extractor: incomplete result object")
+    //ErrOutOfOrder is returned when elements of a multi-value path were
+    //skipped because they arrived out of order.
+    ErrOutOfOrder = errors.New("json_extractor: elements skipped (input out of order?)")
+    //ErrMissingInput is returned (with JReader.OnMissingTransformInput set
+    //to MissingInputError) when a schema transform expression reads a
+    //path that was never found for the current result.
+    ErrMissingInput = errors.New("json_extractor: transform input missing")
+    //ErrOverlappingCapture is returned when a schema captures a whole
+    //subtree (see captureSubtree) while another schema entry requests a
+    //path nested underneath it that can't be resolved from the already-
+    //captured value - i.e. the nested path crosses a wildcard key, slice,
+    //union, predicate or recursive descend. A plain object-key/array-index
+    //nested path (e.g. "obj": ".data", "x": ".data.x") is resolved fine.
+    ErrOverlappingCapture = errors.New("json_extractor: nested path under captured subtree can't be resolved")
+)
+
 var rxMultiMatch *regexp.Regexp = regexp.MustCompile(`^(.*?)(\[(\d*)\])$`)
 
 type resultContainer struct {
     seen []*PathRef
     skipped []*PathRef
-    result map[string]string //map[string]interface{} not yet supported
+    result map[string]string
+    fullState bool
+}
+
+//resultContainerT is resultContainer for ReadTyped/StreamTyped, whose
+//result values keep their native JSON type (number, bool, null, string,
+//or a captured object/array subtree) instead of always being a string.
+type resultContainerT struct {
+    seen []*PathRef
+    skipped []*PathRef
+    result map[string]interface{}
     fullState bool
 }
 
 type pathNode struct {
     index int
     key string
+    wildcardKey bool //object key "*" (JSONPath)
+    descend bool //this node is a ".." recursive descend marker (JSONPath)
+    sliceStart *int //array slice "[start:end:step]" (JSONPath)
+    sliceEnd *int
+    sliceStep *int
+    unionIndices []int //array union "[0,2,4]" (JSONPath)
+    predicate predExpr //"[?(...)]" where-clause on an array segment
 }
 
 type PathRef struct {
@@ -39,346 +83,2692 @@ type PathRef struct {
     knownStringMatches []string
 }
 
-type schemaItem struct {
-    ReqPath *PathRef
-    DstKey string
+//predExpr is a compiled predicate ("where" clause) expression, e.g. the
+//"@.status==\"paid\"" in ".orders[?(@.status==\"paid\")]". It's evaluated
+//against the scalar fields collected from one array element (object).
+type predExpr interface {
+    eval(fields map[string]interface{}) (interface{}, error)
 }
 
-func (self *schemaItem) IsMulti() bool {
-    src := self.ReqPath.String()
-    if strings.HasSuffix(src, "[]") { //TODO not optimal
-        return true
-    }
-    return false
+type predLit struct {
+    val interface{} //string, float64, bool or nil
 }
 
-func newPathRef(pathL []string, atD map[int]*pathNode) *PathRef {
-    //This creates a path reference object.
-    //It references a path node in the data stream.
-    //It can be represented as a string:
-    //Example: .[0].List[0]
-    var pathObj PathRef
-    pathObj.pathL = pathL
-    pathObj.atD = make([]pathNode, len(pathL))
-    for i := range pathL {
-        var node pathNode = *atD[i]
-        pathObj.atD[i] = node
+func (self *predLit) eval(fields map[string]interface{}) (interface{}, error) {
+    return self.val, nil
+}
+
+type predField struct {
+    key string //the "@.key" / "@['key']" being referenced
+}
+
+func (self *predField) eval(fields map[string]interface{}) (interface{}, error) {
+    if v, ok := fields[self.key]; ok {
+        return v, nil
     }
-    return &pathObj
+    return nil, nil //field not present on this element -> null
 }
 
-func NewPath(pathStr string) *PathRef {
-    //This creates a virtual path object from a string,
-    //which could be a user-defined path in the schema.
-    //We use this type of object to be able to compare it with other paths
-    //without having to take the string apart each time.
-    //Note that this "virtual" path object will not be a reference,
-    //unlike the one returned by the other ctor.
-    //Example: .[0].List[0] (absolute path)
-    //Example: .[0].List[] / .[].List[] (multi path)
-    var pathObj PathRef
-    pathObj.raw = pathStr
-    parts := strings.Split(pathStr, ".")
-    for i, part := range parts {
-        if i == 0 {
-            //".[]..." leading point for document start
-            if part != "" {
-                return nil
-            }
-            continue
-        } else {
-            if part == "" {
-                //Empty path part
-                return nil
-            }
-        }
+type predNot struct {
+    x predExpr
+}
 
-        //Structs with metadata
-        node := pathNode{index: -1}
-        foundArray := false
-        indexPart := ""
-        partMod := part
+func (self *predNot) eval(fields map[string]interface{}) (interface{}, error) {
+    v, err := self.x.eval(fields)
+    if err != nil {
+        return nil, err
+    }
+    return !predTruthy(v), nil
+}
 
-        //Add object key
-        multiMatch := rxMultiMatch.FindStringSubmatch(part) //"...[]"
-        if len(multiMatch) > 2 {
-            foundArray = true
-            partMod = multiMatch[1]
-            indexPart = multiMatch[3]
+type predBin struct {
+    op string // "&&" "||" "==" "!=" "<" "<=" ">" ">="
+    l, r predExpr
+}
+
+func (self *predBin) eval(fields map[string]interface{}) (interface{}, error) {
+    switch self.op {
+    case "&&":
+        lv, err := self.l.eval(fields)
+        if err != nil {
+            return nil, err
         }
-        if partMod != "" {
-            node.key = partMod
-            pathObj.pathL = append(pathObj.pathL, "OBJECT")
-            pathObj.atD = append(pathObj.atD, node)
+        if !predTruthy(lv) {
+            return false, nil
         }
-        //hint: this string parser might be slightly buggy
-
-        //Add array
-        if foundArray {
-            node := pathNode{index: -1}
-            if indexPart != "" {
-                if n, err := strconv.Atoi(indexPart); err == nil {
-                    node.index = n
-                } else {
-                    //Not a number (in brackets)
-                    return nil
-                }
-            }
-            pathObj.pathL = append(pathObj.pathL, "ARRAY")
-            pathObj.atD = append(pathObj.atD, node)
+        rv, err := self.r.eval(fields)
+        if err != nil {
+            return nil, err
         }
+        return predTruthy(rv), nil
+    case "||":
+        lv, err := self.l.eval(fields)
+        if err != nil {
+            return nil, err
+        }
+        if predTruthy(lv) {
+            return true, nil
+        }
+        rv, err := self.r.eval(fields)
+        if err != nil {
+            return nil, err
+        }
+        return predTruthy(rv), nil
+    default:
+        lv, err := self.l.eval(fields)
+        if err != nil {
+            return nil, err
+        }
+        rv, err := self.r.eval(fields)
+        if err != nil {
+            return nil, err
+        }
+        return predCompare(self.op, lv, rv)
     }
+}
 
-    return &pathObj
+func predTruthy(v interface{}) bool {
+    switch t := v.(type) {
+    case bool:
+        return t
+    case nil:
+        return false
+    case string:
+        return t != ""
+    case float64:
+        return t != 0
+    }
+    return false
 }
 
-func (self *PathRef) String() string {
-    var pathStr string
-    pathStr = "."
-    for d, l := range self.pathL {
-        node := &self.atD[d]
-        if l == "OBJECT" {
-            //Object delimiter "."
-            pathStr += "."
-            //Key required
-            pathStr += node.key //first one empty (highly likely)
-        } else if l == "ARRAY" {
-            //Object delimiter "[]"
-            var indexStr string
-            if node.index > -1 {
-                indexStr = strconv.Itoa(node.index)
+func predCompare(op string, lv, rv interface{}) (bool, error) {
+    if lf, lok := predAsFloat(lv); lok {
+        if rf, rok := predAsFloat(rv); rok {
+            switch op {
+            case "==": return lf == rf, nil
+            case "!=": return lf != rf, nil
+            case "<": return lf < rf, nil
+            case "<=": return lf <= rf, nil
+            case ">": return lf > rf, nil
+            case ">=": return lf >= rf, nil
             }
-            pathStr = fmt.Sprintf("%s[%s]", pathStr, indexStr)
         }
     }
-    return pathStr
+    ls, rs := predAsString(lv), predAsString(rv)
+    switch op {
+    case "==": return ls == rs, nil
+    case "!=": return ls != rs, nil
+    case "<": return ls < rs, nil
+    case "<=": return ls <= rs, nil
+    case ">": return ls > rs, nil
+    case ">=": return ls >= rs, nil
+    }
+    return false, fmt.Errorf("predicate: unknown operator %q", op)
 }
 
-func (self *PathRef) matches(cmpPath *PathRef) bool {
-    //Check for known string matches first
-    //If this path object references a path in the structure being parsed,
-    //this should be used to compare it with a known path from the schema.
-    //So, if we're at .[2].List[7], it would match a known schema path
-    //".[].List[]" (but not ".[0].List[]").
-    //for _, knownStr := range self.knownStringMatches {
-    //    //TODO ... rely on array, prefilled during parsing, on key...
-    //    //note: this cache/comparison only works if left/self is absolute
-    //    //and right/other is ... wait what
-    //    if knownStr == cmpPath {
-    //        return true
-    //    }
-    //}
-
-    //Compare path ...
-    if len(self.pathL) == 0 {
-        return false
-    }
-    if len(self.pathL) != len(cmpPath.pathL) {
-        return false
-    }
-    for d, l := range self.pathL {
-        //Check type
-        if l != cmpPath.pathL[d] {
-            return false
+func predAsFloat(v interface{}) (float64, bool) {
+    switch t := v.(type) {
+    case float64:
+        return t, true
+    case string:
+        if f, err := strconv.ParseFloat(t, 64); err == nil {
+            return f, true
         }
-        //Check key/position
-        if l == "ARRAY" {
-            //note: unindexed arrays must have index = -1
-            if cmpPath.atD[d].index == -1 {
-                //match any index if other path has unindexed array []
-            } else if self.atD[d].index != cmpPath.atD[d].index {
-                return false
-            }
-        } else if l == "OBJECT" {
-            if self.atD[d].key != cmpPath.atD[d].key {
-                return false
-            }
+    }
+    return 0, false
+}
+
+func predAsString(v interface{}) string {
+    switch t := v.(type) {
+    case nil:
+        return ""
+    case string:
+        return t
+    case bool:
+        if t {
+            return "true"
         }
+        return "false"
+    case float64:
+        return strconv.FormatFloat(t, 'g', -1, 64)
     }
-    return true
+    return fmt.Sprintf("%v", v)
 }
-func (self *PathRef) isArray(i int) bool {
-    return self.pathL[i] == "ARRAY"
+
+//predParser is a small recursive-descent parser for predicate
+//expressions: ==, !=, <, <=, >, >=, &&, ||, !, parentheses, string/
+//number/bool literals and @.key / @['key'] field references.
+type predParser struct {
+    s string
+    i int
 }
 
-//func (self *JReader) inArray() bool {
-//    if len(self.pathL) == 0 {
-//        return false
-//    }
-//    return self.pathL[self.depthIndex()] == "ARRAY"
-//}
-//
-//func (self *JReader) inObject() bool {
-//    if len(self.pathL) == 0 {
-//        return false
-//    }
-//    return self.pathL[self.depthIndex()] == "OBJECT"
-func (self *PathRef) hasIndex(i int) bool {
-    return self.atD[i].index > -1
+func parsePredicate(expr string) (predExpr, error) {
+    p := &predParser{s: expr}
+    node, err := p.parseOr()
+    if err != nil {
+        return nil, err
+    }
+    p.skipSpace()
+    if p.i != len(p.s) {
+        return nil, fmt.Errorf("predicate: unexpected trailing input %q", p.s[p.i:])
+    }
+    return node, nil
 }
 
-type JReader struct {
-    filePath string
-    file io.Reader
-    json *json.Decoder
-    res map[string]string
-    pathL []string
-    atD map[int]*pathNode
-    resState resultContainer
-    schema map[string]string //TODO typedef ...
-    schemaItems []schemaItem
-    srcPathLst []string
-    shortestPathDepthInt int
-    rxMultiMatch *regexp.Regexp
-    reqInfoMap map[string]map[string]string
+func (self *predParser) skipSpace() {
+    for self.i < len(self.s) && self.s[self.i] == ' ' {
+        self.i++
+    }
 }
 
-func NewJReader(ifile string) *JReader {
-    r := &JReader{}
-    r.filePath = ifile
+func (self *predParser) rest() string {
+    return self.s[self.i:]
+}
 
-    if ifile == "" {
-        return nil
+func (self *predParser) parseOr() (predExpr, error) {
+    left, err := self.parseAnd()
+    if err != nil {
+        return nil, err
     }
-    //var file *io.Reader
-    if ifile == "-" {
-        r.file = bufio.NewReader(os.Stdin)
-    } else {
-        if file, err := os.Open(ifile); err == nil {
-            r.file = file
-        } else {
-            fmt.Printf("ERROR - failed to open file %s\n", ifile)
-            os.Exit(1)
+    for {
+        self.skipSpace()
+        if strings.HasPrefix(self.rest(), "||") {
+            self.i += 2
+            right, err := self.parseAnd()
+            if err != nil {
+                return nil, err
+            }
+            left = &predBin{op: "||", l: left, r: right}
+            continue
         }
+        break
     }
-
-    r.json = json.NewDecoder(r.file)
-
-    r.rxMultiMatch = regexp.MustCompile(`^(.*?)(\[\d+\])$`) //TODO obsolete
-
-    r.init()
-
-    return r
+    return left, nil
 }
 
-func (self *JReader) SetSchema(userSchema map[string]string) {
-    //TODO typedef or accept alternative input format
-    self.schema = userSchema
-    self.schemaItems = nil
-    for k, v := range userSchema {
-        newItem := schemaItem{}
-        newItem.ReqPath = NewPath(v)
-        newItem.DstKey = k
-        self.schemaItems = append(self.schemaItems, newItem)
+func (self *predParser) parseAnd() (predExpr, error) {
+    left, err := self.parseNot()
+    if err != nil {
+        return nil, err
     }
-
-    var paths []string
-    for _, p := range self.schema {
-        paths = append(paths, p)
+    for {
+        self.skipSpace()
+        if strings.HasPrefix(self.rest(), "&&") {
+            self.i += 2
+            right, err := self.parseNot()
+            if err != nil {
+                return nil, err
+            }
+            left = &predBin{op: "&&", l: left, r: right}
+            continue
+        }
+        break
     }
-    self.srcPathLst = paths
+    return left, nil
+}
 
-    var depth int
-    for _, p := range self.srcPaths() {
-        d := len(strings.Split(p, "."))
-        if depth == 0 || d < depth {
-            depth = d
+func (self *predParser) parseNot() (predExpr, error) {
+    self.skipSpace()
+    if self.i < len(self.s) && self.s[self.i] == '!' {
+        self.i++
+        x, err := self.parseNot()
+        if err != nil {
+            return nil, err
         }
+        return &predNot{x: x}, nil
     }
-    self.shortestPathDepthInt = depth
+    return self.parseCmp()
+}
 
+func (self *predParser) parseCmp() (predExpr, error) {
+    left, err := self.parsePrimary()
+    if err != nil {
+        return nil, err
+    }
+    self.skipSpace()
+    for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+        if strings.HasPrefix(self.rest(), op) {
+            self.i += len(op)
+            right, err := self.parsePrimary()
+            if err != nil {
+                return nil, err
+            }
+            return &predBin{op: op, l: left, r: right}, nil
+        }
+    }
+    return left, nil
 }
 
-func (self *JReader) init() {
-    self.res = make(map[string]string)
-    self.pathL = nil
-    self.atD = make(map[int]*pathNode)
-    self.resState = resultContainer{} //res stays undefined/nil
-    self.reqInfoMap = make(map[string]map[string]string) //cache
+func (self *predParser) parsePrimary() (predExpr, error) {
+    self.skipSpace()
+    if self.i >= len(self.s) {
+        return nil, fmt.Errorf("predicate: unexpected end of expression")
+    }
+    c := self.s[self.i]
+    if c == '(' {
+        self.i++
+        inner, err := self.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        self.skipSpace()
+        if self.i >= len(self.s) || self.s[self.i] != ')' {
+            return nil, fmt.Errorf("predicate: expected ')'")
+        }
+        self.i++
+        return inner, nil
+    }
+    if c == '@' {
+        return self.parseFieldRef()
+    }
+    if c == '\'' || c == '"' {
+        return self.parseStringLit(c)
+    }
+    if c == '-' || (c >= '0' && c <= '9') {
+        return self.parseNumberLit()
+    }
+    j := self.i
+    for j < len(self.s) && isPredIdentByte(self.s[j]) {
+        j++
+    }
+    word := self.s[self.i:j]
+    self.i = j
+    switch word {
+    case "true": return &predLit{val: true}, nil
+    case "false": return &predLit{val: false}, nil
+    case "null": return &predLit{val: nil}, nil
+    }
+    return nil, fmt.Errorf("predicate: unexpected token %q", word)
 }
 
-func (self *JReader) currentPath() *PathRef {
-    path := newPathRef(self.pathL, self.atD)
-    return path
+func isPredIdentByte(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
 }
 
-func (self *JReader) depth() int {
-    return len(self.pathL)
+func (self *predParser) parseFieldRef() (predExpr, error) {
+    self.i++ //consume '@'
+    if self.i >= len(self.s) || (self.s[self.i] != '.' && self.s[self.i] != '[') {
+        return nil, fmt.Errorf("predicate: expected '.' or '[' after '@'")
+    }
+    if self.s[self.i] == '.' {
+        self.i++
+        j := self.i
+        for j < len(self.s) && isPredIdentByte(self.s[j]) {
+            j++
+        }
+        if j == self.i {
+            return nil, fmt.Errorf("predicate: expected field name after '@.'")
+        }
+        key := self.s[self.i:j]
+        self.i = j
+        return &predField{key: key}, nil
+    }
+    //Bracket form: @['key']
+    self.i++ //consume '['
+    if self.i >= len(self.s) || (self.s[self.i] != '\'' && self.s[self.i] != '"') {
+        return nil, fmt.Errorf("predicate: expected quoted key in '@[...]'")
+    }
+    quote := self.s[self.i]
+    self.i++
+    j := self.i
+    for j < len(self.s) && self.s[j] != quote {
+        j++
+    }
+    if j >= len(self.s) {
+        return nil, fmt.Errorf("predicate: unterminated string in '@[...]'")
+    }
+    key := self.s[self.i:j]
+    self.i = j + 1
+    if self.i >= len(self.s) || self.s[self.i] != ']' {
+        return nil, fmt.Errorf("predicate: expected ']' after '@[...'")
+    }
+    self.i++
+    return &predField{key: key}, nil
 }
 
-func (self *JReader) depthIndex() int {
-    return self.depth() - 1
+func (self *predParser) parseStringLit(quote byte) (predExpr, error) {
+    self.i++ //consume opening quote
+    j := self.i
+    for j < len(self.s) && self.s[j] != quote {
+        j++
+    }
+    if j >= len(self.s) {
+        return nil, fmt.Errorf("predicate: unterminated string literal")
+    }
+    val := self.s[self.i:j]
+    self.i = j + 1
+    return &predLit{val: val}, nil
 }
 
-func (self *JReader) currentNode() *pathNode {
+func (self *predParser) parseNumberLit() (predExpr, error) {
+    j := self.i
+    if self.s[j] == '-' {
+        j++
+    }
+    for j < len(self.s) && ((self.s[j] >= '0' && self.s[j] <= '9') || self.s[j] == '.') {
+        j++
+    }
+    numStr := self.s[self.i:j]
+    f, err := strconv.ParseFloat(numStr, 64)
+    if err != nil {
+        return nil, fmt.Errorf("predicate: bad number %q", numStr)
+    }
+    self.i = j
+    return &predLit{val: f}, nil
+}
+
+//xformExpr is a compiled schema-value transform expression, e.g. the
+//"| int" in ".user.age | int" or the whole right-hand side of
+//".user.first + ' ' + .user.last". It's evaluated once a result object's
+//declared paths have all been collected, against those collected values
+//(see JReader.applyTransforms).
+type xformExpr interface {
+    eval(env map[string]interface{}) (interface{}, error)
+}
+
+type xformLit struct {
+    val interface{} //string, float64 or bool
+}
+
+func (self *xformLit) eval(env map[string]interface{}) (interface{}, error) {
+    return self.val, nil
+}
+
+//xformPathRef is a ".foo.bar" path embedded in a transform expression; it
+//reads the value collected under that path by its shadow schemaItem (see
+//xformInputKey), or null if that path was never found for this result.
+type xformPathRef struct {
+    path *PathRef
+}
+
+func (self *xformPathRef) eval(env map[string]interface{}) (interface{}, error) {
+    return env[xformInputKey(self.path.raw)], nil
+}
+
+type xformUnary struct {
+    op string // "!" "-"
+    x xformExpr
+}
+
+func (self *xformUnary) eval(env map[string]interface{}) (interface{}, error) {
+    v, err := self.x.eval(env)
+    if err != nil {
+        return nil, err
+    }
+    if self.op == "!" {
+        return !predTruthy(v), nil
+    }
+    f, _ := predAsFloat(v)
+    return -f, nil
+}
+
+type xformBinary struct {
+    op string // "&&" "||" "==" "!=" "<" "<=" ">" ">=" "+" "-" "*" "/"
+    l, r xformExpr
+}
+
+func (self *xformBinary) eval(env map[string]interface{}) (interface{}, error) {
+    switch self.op {
+    case "&&":
+        lv, err := self.l.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        if !predTruthy(lv) {
+            return false, nil
+        }
+        rv, err := self.r.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        return predTruthy(rv), nil
+    case "||":
+        lv, err := self.l.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        if predTruthy(lv) {
+            return true, nil
+        }
+        rv, err := self.r.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        return predTruthy(rv), nil
+    case "==", "!=", "<", "<=", ">", ">=":
+        lv, err := self.l.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        rv, err := self.r.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        return predCompare(self.op, lv, rv)
+    case "+":
+        lv, err := self.l.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        rv, err := self.r.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        if lf, lok := predAsFloat(lv); lok {
+            if rf, rok := predAsFloat(rv); rok {
+                return lf + rf, nil
+            }
+        }
+        return predAsString(lv) + predAsString(rv), nil
+    case "-", "*", "/":
+        lv, err := self.l.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        rv, err := self.r.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        lf, _ := predAsFloat(lv)
+        rf, _ := predAsFloat(rv)
+        switch self.op {
+        case "-":
+            return lf - rf, nil
+        case "*":
+            return lf * rf, nil
+        case "/":
+            if rf == 0 {
+                return nil, fmt.Errorf("transform: division by zero")
+            }
+            return lf / rf, nil
+        }
+    }
+    return nil, fmt.Errorf("transform: unknown operator %q", self.op)
+}
+
+type xformTernary struct {
+    cond, a, b xformExpr
+}
+
+func (self *xformTernary) eval(env map[string]interface{}) (interface{}, error) {
+    cv, err := self.cond.eval(env)
+    if err != nil {
+        return nil, err
+    }
+    if predTruthy(cv) {
+        return self.a.eval(env)
+    }
+    return self.b.eval(env)
+}
+
+//xformCall is a built-in function call, e.g. "int(...)" or the pipe
+//sugar "... | int" (the piped value becomes the first argument). See
+//callXformBuiltin for the supported built-ins.
+type xformCall struct {
+    name string
+    args []xformExpr
+}
+
+func (self *xformCall) eval(env map[string]interface{}) (interface{}, error) {
+    argv := make([]interface{}, len(self.args))
+    for i, a := range self.args {
+        v, err := a.eval(env)
+        if err != nil {
+            return nil, err
+        }
+        argv[i] = v
+    }
+    return callXformBuiltin(self.name, argv)
+}
+
+//callXformBuiltin implements the transform expression built-ins: int,
+//float, lower, upper, len, default(x,y), regex_match, regex_replace.
+func callXformBuiltin(name string, args []interface{}) (interface{}, error) {
+    switch name {
+    case "int":
+        if len(args) != 1 {
+            return nil, fmt.Errorf("transform: int() takes 1 argument")
+        }
+        f, _ := predAsFloat(args[0])
+        return float64(int64(f)), nil
+    case "float":
+        if len(args) != 1 {
+            return nil, fmt.Errorf("transform: float() takes 1 argument")
+        }
+        f, _ := predAsFloat(args[0])
+        return f, nil
+    case "lower":
+        if len(args) != 1 {
+            return nil, fmt.Errorf("transform: lower() takes 1 argument")
+        }
+        return strings.ToLower(predAsString(args[0])), nil
+    case "upper":
+        if len(args) != 1 {
+            return nil, fmt.Errorf("transform: upper() takes 1 argument")
+        }
+        return strings.ToUpper(predAsString(args[0])), nil
+    case "len":
+        if len(args) != 1 {
+            return nil, fmt.Errorf("transform: len() takes 1 argument")
+        }
+        switch v := args[0].(type) {
+        case nil:
+            return float64(0), nil
+        case []interface{}:
+            return float64(len(v)), nil
+        case map[string]interface{}:
+            return float64(len(v)), nil
+        default:
+            return float64(len(predAsString(v))), nil
+        }
+    case "default":
+        if len(args) != 2 {
+            return nil, fmt.Errorf("transform: default() takes 2 arguments")
+        }
+        if args[0] == nil || args[0] == "" {
+            return args[1], nil
+        }
+        return args[0], nil
+    case "regex_match":
+        if len(args) != 2 {
+            return nil, fmt.Errorf("transform: regex_match() takes 2 arguments")
+        }
+        re, err := regexp.Compile(predAsString(args[1]))
+        if err != nil {
+            return nil, fmt.Errorf("transform: bad regex_match pattern: %w", err)
+        }
+        return re.MatchString(predAsString(args[0])), nil
+    case "regex_replace":
+        if len(args) != 3 {
+            return nil, fmt.Errorf("transform: regex_replace() takes 3 arguments")
+        }
+        re, err := regexp.Compile(predAsString(args[1]))
+        if err != nil {
+            return nil, fmt.Errorf("transform: bad regex_replace pattern: %w", err)
+        }
+        return re.ReplaceAllString(predAsString(args[0]), predAsString(args[2])), nil
+    }
+    return nil, fmt.Errorf("transform: unknown function %q", name)
+}
+
+//xformParser is a small recursive-descent parser for schema transform
+//expressions: ternary, &&, ||, ==, !=, <, <=, >, >=, +, -, *, /, !,
+//parentheses, string/number/bool literals, ".foo.bar" path references,
+//function calls and the "expr | filter(...)" pipe sugar (same style as
+//predParser, extended for arithmetic and pipes). Precedence, loosest to
+//tightest: ternary, ||, &&, comparison, +/-, */, unary, pipe. Pipe binds
+//tighter than everything else so "a | f() ? x : y" pipes "a" through f()
+//and then uses that result as the ternary condition.
+type xformParser struct {
+    s string
+    i int
+}
+
+//parseTransform parses expr as a transform expression; see xformParser.
+func parseTransform(expr string) (xformExpr, error) {
+    p := &xformParser{s: expr}
+    node, err := p.parseTernary()
+    if err != nil {
+        return nil, err
+    }
+    p.skipSpace()
+    if p.i != len(p.s) {
+        return nil, fmt.Errorf("transform: unexpected trailing input %q", p.s[p.i:])
+    }
+    return node, nil
+}
+
+func (self *xformParser) skipSpace() {
+    for self.i < len(self.s) && self.s[self.i] == ' ' {
+        self.i++
+    }
+}
+
+func (self *xformParser) rest() string {
+    return self.s[self.i:]
+}
+
+//parsePipe parses a primary expression followed by zero or more
+//"| filter(...)" stages. It sits directly above parsePrimary (below all
+//the arithmetic/comparison/ternary levels) so that a piped expression is
+//consumed as a single operand before any of those outer operators see it
+//- e.g. "a | f() ? x : y" pipes "a" through f() first and then uses the
+//result as the ternary condition, rather than the pipe splitting across
+//the ternary.
+func (self *xformParser) parsePipe() (xformExpr, error) {
+    left, err := self.parsePrimary()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        self.skipSpace()
+        if self.i < len(self.s) && self.s[self.i] == '|' {
+            self.i++
+            name, args, err := self.parseFilterCall()
+            if err != nil {
+                return nil, err
+            }
+            left = &xformCall{name: name, args: append([]xformExpr{left}, args...)}
+            continue
+        }
+        break
+    }
+    return left, nil
+}
+
+//parseFilterCall parses the "filter" or "filter(args...)" on the right
+//of a "|" in a pipe expression.
+func (self *xformParser) parseFilterCall() (string, []xformExpr, error) {
+    self.skipSpace()
+    j := self.i
+    for j < len(self.s) && isXformIdentByte(self.s[j]) {
+        j++
+    }
+    if j == self.i {
+        return "", nil, fmt.Errorf("transform: expected filter name after '|'")
+    }
+    name := self.s[self.i:j]
+    self.i = j
+    self.skipSpace()
+    var args []xformExpr
+    if self.i < len(self.s) && self.s[self.i] == '(' {
+        self.i++
+        a, err := self.parseArgs()
+        if err != nil {
+            return "", nil, err
+        }
+        args = a
+        self.skipSpace()
+        if self.i >= len(self.s) || self.s[self.i] != ')' {
+            return "", nil, fmt.Errorf("transform: expected ')' after filter arguments")
+        }
+        self.i++
+    }
+    return name, args, nil
+}
+
+func (self *xformParser) parseArgs() ([]xformExpr, error) {
+    var args []xformExpr
+    self.skipSpace()
+    if self.i < len(self.s) && self.s[self.i] == ')' {
+        return args, nil
+    }
+    for {
+        arg, err := self.parseTernary()
+        if err != nil {
+            return nil, err
+        }
+        args = append(args, arg)
+        self.skipSpace()
+        if self.i < len(self.s) && self.s[self.i] == ',' {
+            self.i++
+            continue
+        }
+        break
+    }
+    return args, nil
+}
+
+func (self *xformParser) parseTernary() (xformExpr, error) {
+    cond, err := self.parseOr()
+    if err != nil {
+        return nil, err
+    }
+    self.skipSpace()
+    if self.i < len(self.s) && self.s[self.i] == '?' {
+        self.i++
+        a, err := self.parseTernary()
+        if err != nil {
+            return nil, err
+        }
+        self.skipSpace()
+        if self.i >= len(self.s) || self.s[self.i] != ':' {
+            return nil, fmt.Errorf("transform: expected ':' in ternary expression")
+        }
+        self.i++
+        b, err := self.parseTernary()
+        if err != nil {
+            return nil, err
+        }
+        return &xformTernary{cond: cond, a: a, b: b}, nil
+    }
+    return cond, nil
+}
+
+func (self *xformParser) parseOr() (xformExpr, error) {
+    left, err := self.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        self.skipSpace()
+        if strings.HasPrefix(self.rest(), "||") {
+            self.i += 2
+            right, err := self.parseAnd()
+            if err != nil {
+                return nil, err
+            }
+            left = &xformBinary{op: "||", l: left, r: right}
+            continue
+        }
+        break
+    }
+    return left, nil
+}
+
+func (self *xformParser) parseAnd() (xformExpr, error) {
+    left, err := self.parseCmp()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        self.skipSpace()
+        if strings.HasPrefix(self.rest(), "&&") {
+            self.i += 2
+            right, err := self.parseCmp()
+            if err != nil {
+                return nil, err
+            }
+            left = &xformBinary{op: "&&", l: left, r: right}
+            continue
+        }
+        break
+    }
+    return left, nil
+}
+
+func (self *xformParser) parseCmp() (xformExpr, error) {
+    left, err := self.parseAdd()
+    if err != nil {
+        return nil, err
+    }
+    self.skipSpace()
+    for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+        if strings.HasPrefix(self.rest(), op) {
+            self.i += len(op)
+            right, err := self.parseAdd()
+            if err != nil {
+                return nil, err
+            }
+            return &xformBinary{op: op, l: left, r: right}, nil
+        }
+    }
+    return left, nil
+}
+
+func (self *xformParser) parseAdd() (xformExpr, error) {
+    left, err := self.parseMul()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        self.skipSpace()
+        if self.i < len(self.s) && (self.s[self.i] == '+' || self.s[self.i] == '-') {
+            op := string(self.s[self.i])
+            self.i++
+            right, err := self.parseMul()
+            if err != nil {
+                return nil, err
+            }
+            left = &xformBinary{op: op, l: left, r: right}
+            continue
+        }
+        break
+    }
+    return left, nil
+}
+
+func (self *xformParser) parseMul() (xformExpr, error) {
+    left, err := self.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        self.skipSpace()
+        if self.i < len(self.s) && (self.s[self.i] == '*' || self.s[self.i] == '/') {
+            op := string(self.s[self.i])
+            self.i++
+            right, err := self.parseUnary()
+            if err != nil {
+                return nil, err
+            }
+            left = &xformBinary{op: op, l: left, r: right}
+            continue
+        }
+        break
+    }
+    return left, nil
+}
+
+func (self *xformParser) parseUnary() (xformExpr, error) {
+    self.skipSpace()
+    if self.i < len(self.s) && self.s[self.i] == '!' {
+        self.i++
+        x, err := self.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return &xformUnary{op: "!", x: x}, nil
+    }
+    if self.i < len(self.s) && self.s[self.i] == '-' {
+        self.i++
+        x, err := self.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return &xformUnary{op: "-", x: x}, nil
+    }
+    return self.parsePipe()
+}
+
+func (self *xformParser) parsePrimary() (xformExpr, error) {
+    self.skipSpace()
+    if self.i >= len(self.s) {
+        return nil, fmt.Errorf("transform: unexpected end of expression")
+    }
+    c := self.s[self.i]
+    if c == '(' {
+        self.i++
+        inner, err := self.parseTernary()
+        if err != nil {
+            return nil, err
+        }
+        self.skipSpace()
+        if self.i >= len(self.s) || self.s[self.i] != ')' {
+            return nil, fmt.Errorf("transform: expected ')'")
+        }
+        self.i++
+        return inner, nil
+    }
+    if c == '\'' || c == '"' {
+        return self.parseStringLit(c)
+    }
+    if c >= '0' && c <= '9' {
+        return self.parseNumberLit()
+    }
+    if c == '.' {
+        return self.parsePathLit()
+    }
+    j := self.i
+    for j < len(self.s) && isXformIdentByte(self.s[j]) {
+        j++
+    }
+    if j == self.i {
+        return nil, fmt.Errorf("transform: unexpected character %q", string(c))
+    }
+    word := self.s[self.i:j]
+    self.i = j
+    switch word {
+    case "true":
+        return &xformLit{val: true}, nil
+    case "false":
+        return &xformLit{val: false}, nil
+    case "null":
+        return &xformLit{val: nil}, nil
+    }
+    self.skipSpace()
+    if self.i < len(self.s) && self.s[self.i] == '(' {
+        self.i++
+        args, err := self.parseArgs()
+        if err != nil {
+            return nil, err
+        }
+        self.skipSpace()
+        if self.i >= len(self.s) || self.s[self.i] != ')' {
+            return nil, fmt.Errorf("transform: expected ')' after arguments to %q", word)
+        }
+        self.i++
+        return &xformCall{name: word, args: args}, nil
+    }
+    return nil, fmt.Errorf("transform: unexpected identifier %q", word)
+}
+
+func isXformIdentByte(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (self *xformParser) parseStringLit(quote byte) (xformExpr, error) {
+    self.i++ //consume opening quote
+    j := self.i
+    for j < len(self.s) && self.s[j] != quote {
+        j++
+    }
+    if j >= len(self.s) {
+        return nil, fmt.Errorf("transform: unterminated string literal")
+    }
+    val := self.s[self.i:j]
+    self.i = j + 1
+    return &xformLit{val: val}, nil
+}
+
+func (self *xformParser) parseNumberLit() (xformExpr, error) {
+    j := self.i
+    for j < len(self.s) && ((self.s[j] >= '0' && self.s[j] <= '9') || self.s[j] == '.') {
+        j++
+    }
+    numStr := self.s[self.i:j]
+    f, err := strconv.ParseFloat(numStr, 64)
+    if err != nil {
+        return nil, fmt.Errorf("transform: bad number %q", numStr)
+    }
+    self.i = j
+    return &xformLit{val: f}, nil
+}
+
+//parsePathLit parses a bare schema path reference such as ".user.first"
+//embedded in a transform expression: a run of path syntax characters
+//starting at '.', handed to NewPath unmodified.
+func (self *xformParser) parsePathLit() (xformExpr, error) {
+    j := self.i
+    for j < len(self.s) && isXformPathByte(self.s[j]) {
+        j++
+    }
+    raw := self.s[self.i:j]
+    path := NewPath(raw)
+    if path == nil {
+        return nil, fmt.Errorf("transform: bad path %q", raw)
+    }
+    self.i = j
+    return &xformPathRef{path: path}, nil
+}
+
+func isXformPathByte(c byte) bool {
+    return c == '.' || c == '[' || c == ']' || c == '_' || c == '*' ||
+        (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+//looksLikeTransform reports whether v contains expression syntax (a
+//pipe, operator, parenthesized call or quoted literal) outside of any
+//"[...]" segment, as opposed to being a plain schema path. A "[?(...)]"
+//where-clause's own operators are inside such a segment and don't count,
+//and neither does a "*" right after "." (a path wildcard such as ".a.*").
+func looksLikeTransform(v string) bool {
+    depth := 0
+    for i := 0; i < len(v); i++ {
+        c := v[i]
+        if c == '[' {
+            depth++
+            continue
+        }
+        if c == ']' {
+            if depth > 0 {
+                depth--
+            }
+            continue
+        }
+        if depth > 0 {
+            continue
+        }
+        switch c {
+        case '|', '+', '-', '/', '?', '(', '\'', '"', '=', '<', '>', '&', '!':
+            return true
+        case '*':
+            if i == 0 || v[i-1] != '.' {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+//parseMaybeTransform parses v as a transform expression if it looks like
+//one (see looksLikeTransform), returning the compiled expression and the
+//distinct schema paths it reads (each becomes a shadow schemaItem, see
+//SetSchema and xformInputKey). A plain path is left for the caller to
+//parse as before.
+func parseMaybeTransform(v string) (xformExpr, []*PathRef, bool) {
+    if !looksLikeTransform(v) {
+        return nil, nil, false
+    }
+    expr, err := parseTransform(v)
+    if err != nil {
+        return nil, nil, false
+    }
+    var paths []*PathRef
+    seen := make(map[string]bool)
+    collectTransformPaths(expr, &paths, seen)
+    return expr, paths, true
+}
+
+func collectTransformPaths(e xformExpr, out *[]*PathRef, seen map[string]bool) {
+    switch n := e.(type) {
+    case *xformPathRef:
+        if !seen[n.path.raw] {
+            seen[n.path.raw] = true
+            *out = append(*out, n.path)
+        }
+    case *xformUnary:
+        collectTransformPaths(n.x, out, seen)
+    case *xformBinary:
+        collectTransformPaths(n.l, out, seen)
+        collectTransformPaths(n.r, out, seen)
+    case *xformTernary:
+        collectTransformPaths(n.cond, out, seen)
+        collectTransformPaths(n.a, out, seen)
+        collectTransformPaths(n.b, out, seen)
+    case *xformCall:
+        for _, a := range n.args {
+            collectTransformPaths(a, out, seen)
+        }
+    }
+}
+
+//xformInputPrefix keys a transform's underlying path values in a result
+//map under a key no real DstKey can collide with, so applyTransforms can
+//read them and then strip them before the result is returned to the
+//caller. See SetSchema's shadow schemaItems.
+const xformInputPrefix = "\x00xform:"
+
+func xformInputKey(raw string) string {
+    return xformInputPrefix + raw
+}
+
+//firstMissingTransformInput returns the raw path of the first input e
+//reads that's absent from env, or "" if all of them are present.
+func firstMissingTransformInput(e xformExpr, env map[string]interface{}) string {
+    switch n := e.(type) {
+    case *xformPathRef:
+        if _, ok := env[xformInputKey(n.path.raw)]; !ok {
+            return n.path.raw
+        }
+    case *xformUnary:
+        return firstMissingTransformInput(n.x, env)
+    case *xformBinary:
+        if m := firstMissingTransformInput(n.l, env); m != "" {
+            return m
+        }
+        return firstMissingTransformInput(n.r, env)
+    case *xformTernary:
+        if m := firstMissingTransformInput(n.cond, env); m != "" {
+            return m
+        }
+        if m := firstMissingTransformInput(n.a, env); m != "" {
+            return m
+        }
+        return firstMissingTransformInput(n.b, env)
+    case *xformCall:
+        for _, a := range n.args {
+            if m := firstMissingTransformInput(a, env); m != "" {
+                return m
+            }
+        }
+    }
+    return ""
+}
+
+type schemaItem struct {
+    ReqPath *PathRef
+    DstKey string
+    //Transform is the compiled expression for a schema value like
+    //".user.age | int" or ".user.first + ' ' + .user.last", or nil for a
+    //schema value that's just a plain path (see parseMaybeTransform).
+    //ReqPath is nil for a Transform item - it has no stream location of
+    //its own, only the shadow schemaItems SetSchema adds for the paths
+    //it reads.
+    Transform xformExpr
+}
+
+func (self *schemaItem) IsMulti() bool {
+    //A path is "multi" if it can match more than one location in the
+    //stream: an unindexed/sliced/union array, a wildcard object key,
+    //or a recursive descend anywhere along the path.
+    for i, l := range self.ReqPath.pathL {
+        node := self.ReqPath.atD[i]
+        if l == "ARRAY" {
+            if node.index == -1 || node.sliceStart != nil || node.sliceEnd != nil ||
+                node.sliceStep != nil || node.unionIndices != nil {
+                return true
+            }
+        } else if l == "OBJECT" && node.wildcardKey {
+            return true
+        } else if l == "DESCEND" {
+            return true
+        }
+    }
+    return false
+}
+
+func newPathRef(pathL []string, atD map[int]*pathNode) *PathRef {
+    //This creates a path reference object.
+    //It references a path node in the data stream.
+    //It can be represented as a string:
+    //Example: .[0].List[0]
+    var pathObj PathRef
+    pathObj.pathL = pathL
+    pathObj.atD = make([]pathNode, len(pathL))
+    for i := range pathL {
+        var node pathNode = *atD[i]
+        pathObj.atD[i] = node
+    }
+    return &pathObj
+}
+
+func NewPath(pathStr string) *PathRef {
+    //This creates a virtual path object from a string,
+    //which could be a user-defined path in the schema.
+    //We use this type of object to be able to compare it with other paths
+    //without having to take the string apart each time.
+    //Note that this "virtual" path object will not be a reference,
+    //unlike the one returned by the other ctor.
+    //Example: .[0].List[0] (absolute path)
+    //Example: .[0].List[] / .[].List[] (multi path)
+    var pathObj PathRef
+    pathObj.raw = pathStr
+    parts := splitPathParts(pathStr)
+    for i, part := range parts {
+        if i == 0 {
+            //".[]..." leading point for document start
+            if part != "" {
+                return nil
+            }
+            continue
+        } else {
+            if part == "" {
+                //Empty path part
+                return nil
+            }
+        }
+
+        //A "where" predicate, e.g. "orders[?(@.status==\"paid\")]",
+        //filters the elements of an (unindexed) array; extract it first
+        //since it may itself contain dots and brackets.
+        var pred predExpr
+        if rest, predStr, found := extractPredicate(part); found {
+            p, err := parsePredicate(predStr)
+            if err != nil {
+                //Malformed predicate expression
+                return nil
+            }
+            pred = p
+            part = rest
+        }
+
+        //Structs with metadata
+        node := pathNode{index: -1}
+        foundArray := pred != nil
+        indexPart := ""
+        partMod := part
+
+        //Add object key
+        multiMatch := rxMultiMatch.FindStringSubmatch(part) //"...[]"
+        if len(multiMatch) > 2 {
+            foundArray = true
+            partMod = multiMatch[1]
+            indexPart = multiMatch[3]
+        }
+        if partMod != "" {
+            node.key = partMod
+            pathObj.pathL = append(pathObj.pathL, "OBJECT")
+            pathObj.atD = append(pathObj.atD, node)
+        }
+        //hint: this string parser might be slightly buggy
+
+        //Add array
+        if foundArray {
+            node := pathNode{index: -1}
+            if indexPart != "" {
+                if n, err := strconv.Atoi(indexPart); err == nil {
+                    node.index = n
+                } else {
+                    //Not a number (in brackets)
+                    return nil
+                }
+            }
+            node.predicate = pred
+            pathObj.pathL = append(pathObj.pathL, "ARRAY")
+            pathObj.atD = append(pathObj.atD, node)
+        }
+    }
+
+    return &pathObj
+}
+
+//splitPathParts splits a path string on "." like strings.Split, except
+//dots inside a "[...]" segment (e.g. a predicate's "@.field") don't
+//count as separators.
+func splitPathParts(pathStr string) []string {
+    var parts []string
+    var cur strings.Builder
+    depth := 0
+    for i := 0; i < len(pathStr); i++ {
+        c := pathStr[i]
+        if c == '[' {
+            depth++
+        } else if c == ']' && depth > 0 {
+            depth--
+        }
+        if c == '.' && depth == 0 {
+            parts = append(parts, cur.String())
+            cur.Reset()
+            continue
+        }
+        cur.WriteByte(c)
+    }
+    parts = append(parts, cur.String())
+    return parts
+}
+
+//extractPredicate pulls a "[?(...)]" where-clause out of a path part,
+//returning the part with the predicate removed and the raw expression.
+func extractPredicate(part string) (rest string, predStr string, found bool) {
+    idx := strings.Index(part, "[?(")
+    if idx == -1 {
+        return part, "", false
+    }
+    depth := 1 //the "(" in "[?(" already opened one level
+    j := idx + 3
+    for ; j < len(part); j++ {
+        if part[j] == '(' {
+            depth++
+        } else if part[j] == ')' {
+            depth--
+            if depth == 0 {
+                break
+            }
+        }
+    }
+    if depth != 0 || j+1 >= len(part) || part[j+1] != ']' {
+        return part, "", false
+    }
+    predStr = part[idx+3 : j]
+    rest = part[:idx] + part[j+2:]
+    return rest, predStr, true
+}
+
+//NewJSONPath creates a path reference from a standard JSONPath expression,
+//as an alternative to the bespoke syntax accepted by NewPath.
+//Supported: root "$", child "." / bracket ['key'], recursive descend "..",
+//wildcards "*" (key or index), array slices "[start:end:step]" and
+//union indices "[0,2,4]". A negative single index (e.g. "[-1]") is
+//rejected with an error; negative numbers in a slice or union are taken
+//as plain numbers, not counted from the end of the array.
+//Example: $.orders[*].total
+//Example: $..price
+//Example: $.list[0:10:2]
+func NewJSONPath(expr string) (*PathRef, error) {
+    if !strings.HasPrefix(expr, "$") {
+        return nil, fmt.Errorf("jsonpath: expression must start with '$': %q", expr)
+    }
+    rest := expr[1:]
+
+    var pathObj PathRef
+    pathObj.raw = expr
+
+    i, n := 0, len(rest)
+    for i < n {
+        c := rest[i]
+        switch {
+        case c == '.':
+            if i+1 < n && rest[i+1] == '.' {
+                pathObj.pathL = append(pathObj.pathL, "DESCEND")
+                pathObj.atD = append(pathObj.atD, pathNode{index: -1, descend: true})
+                i += 2
+                continue
+            }
+            i++
+        case c == '[':
+            j := strings.IndexByte(rest[i:], ']')
+            if j == -1 {
+                return nil, fmt.Errorf("jsonpath: unterminated '[' in %q", expr)
+            }
+            inner := rest[i+1 : i+j]
+            i += j + 1
+            node, label, err := parseJSONPathBracket(inner)
+            if err != nil {
+                return nil, err
+            }
+            pathObj.pathL = append(pathObj.pathL, label)
+            pathObj.atD = append(pathObj.atD, node)
+        default:
+            j := i
+            for j < n && rest[j] != '.' && rest[j] != '[' {
+                j++
+            }
+            key := rest[i:j]
+            i = j
+            if key == "" {
+                return nil, fmt.Errorf("jsonpath: empty key in %q", expr)
+            }
+            node := pathNode{index: -1}
+            if key == "*" {
+                node.wildcardKey = true
+            } else {
+                node.key = key
+            }
+            pathObj.pathL = append(pathObj.pathL, "OBJECT")
+            pathObj.atD = append(pathObj.atD, node)
+        }
+    }
+
+    return &pathObj, nil
+}
+
+//parseJSONPathBracket parses the contents of a single "[...]" segment.
+func parseJSONPathBracket(inner string) (pathNode, string, error) {
+    node := pathNode{index: -1}
+
+    if inner == "*" {
+        //Wildcard array index; index == -1 already means "match any".
+        return node, "ARRAY", nil
+    }
+
+    if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+        //Bracket object key, e.g. ['key']
+        node.key = inner[1 : len(inner)-1]
+        return node, "OBJECT", nil
+    }
+
+    if strings.Contains(inner, ":") {
+        //Slice [start:end:step]
+        parts := strings.Split(inner, ":")
+        if len(parts) > 3 {
+            return node, "", fmt.Errorf("jsonpath: bad slice %q", inner)
+        }
+        if parts[0] != "" {
+            v, err := strconv.Atoi(parts[0])
+            if err != nil {
+                return node, "", fmt.Errorf("jsonpath: bad slice start %q", parts[0])
+            }
+            node.sliceStart = &v
+        }
+        if len(parts) > 1 && parts[1] != "" {
+            v, err := strconv.Atoi(parts[1])
+            if err != nil {
+                return node, "", fmt.Errorf("jsonpath: bad slice end %q", parts[1])
+            }
+            node.sliceEnd = &v
+        }
+        if len(parts) > 2 && parts[2] != "" {
+            v, err := strconv.Atoi(parts[2])
+            if err != nil {
+                return node, "", fmt.Errorf("jsonpath: bad slice step %q", parts[2])
+            }
+            node.sliceStep = &v
+        }
+        return node, "ARRAY", nil
+    }
+
+    if strings.Contains(inner, ",") {
+        //Union [0,2,4]
+        var idxs []int
+        for _, p := range strings.Split(inner, ",") {
+            v, err := strconv.Atoi(strings.TrimSpace(p))
+            if err != nil {
+                return node, "", fmt.Errorf("jsonpath: bad union index %q", p)
+            }
+            idxs = append(idxs, v)
+        }
+        node.unionIndices = idxs
+        return node, "ARRAY", nil
+    }
+
+    if v, err := strconv.Atoi(inner); err == nil {
+        if v < 0 {
+            //A negative index (e.g. "[-1]" for "last element") would
+            //require knowing the array's length, which a forward-only
+            //stream doesn't have until the array is already closed - it
+            //could never match while streaming. Reject it here instead of
+            //accepting it as a path that silently never matches.
+            return node, "", fmt.Errorf("jsonpath: negative index %q is not supported (requires buffering)", inner)
+        }
+        node.index = v
+        return node, "ARRAY", nil
+    }
+
+    //Unquoted bracket key, e.g. [key] - not standard JSONPath, tolerated.
+    node.key = inner
+    return node, "OBJECT", nil
+}
+
+func (self *PathRef) String() string {
+    var pathStr string
+    pathStr = "."
+    for d, l := range self.pathL {
+        node := &self.atD[d]
+        if l == "DESCEND" {
+            pathStr += "."
+        } else if l == "OBJECT" {
+            //Object delimiter "."
+            pathStr += "."
+            //Key required
+            if node.wildcardKey {
+                pathStr += "*"
+            } else {
+                pathStr += node.key //first one empty (highly likely)
+            }
+        } else if l == "ARRAY" {
+            //Object delimiter "[]"
+            var indexStr string
+            if node.index > -1 {
+                indexStr = strconv.Itoa(node.index)
+            }
+            pathStr = fmt.Sprintf("%s[%s]", pathStr, indexStr)
+        }
+    }
+    return pathStr
+}
+
+func (self *PathRef) matches(cmpPath *PathRef) bool {
+    //Check for known string matches first
+    //If this path object references a path in the structure being parsed,
+    //this should be used to compare it with a known path from the schema.
+    //So, if we're at .[2].List[7], it would match a known schema path
+    //".[].List[]" (but not ".[0].List[]").
+    //for _, knownStr := range self.knownStringMatches {
+    //    //TODO ... rely on array, prefilled during parsing, on key...
+    //    //note: this cache/comparison only works if left/self is absolute
+    //    //and right/other is ... wait what
+    //    if knownStr == cmpPath {
+    //        return true
+    //    }
+    //}
+
+    //Compare path ... self is the concrete/absolute path, cmpPath is the
+    //(possibly JSONPath-derived) pattern; cmpPath may contain recursive
+    //descend ("..") markers, so the two path lists can differ in length.
+    if len(self.pathL) == 0 {
+        return false
+    }
+    return matchPathSeq(self.pathL, self.atD, 0, cmpPath.pathL, cmpPath.atD, 0)
+}
+
+//matchPathSeq recursively matches the concrete path (curL/curD, at ci)
+//against the pattern (patL/patD, at pi), backtracking over "DESCEND"
+//markers which may consume zero or more concrete levels.
+func matchPathSeq(curL []string, curD []pathNode, ci int, patL []string, patD []pathNode, pi int) bool {
+    if pi == len(patL) {
+        return ci == len(curL)
+    }
+    patNode := patD[pi]
+    patType := patL[pi]
+
+    if patType == "DESCEND" {
+        for k := ci; k <= len(curL); k++ {
+            if matchPathSeq(curL, curD, k, patL, patD, pi+1) {
+                return true
+            }
+        }
+        return false
+    }
+
+    if ci >= len(curL) {
+        return false
+    }
+    if patType != curL[ci] {
+        return false
+    }
+    if !pathNodeMatches(curD[ci], patNode, patType) {
+        return false
+    }
+    return matchPathSeq(curL, curD, ci+1, patL, patD, pi+1)
+}
+
+//prefixMayMatch reports whether the pattern (patL/patD, at pi) could
+//still match curL/curD (at ci) or anything below it, i.e. whether curL
+//is consistent with being a (possibly partial) prefix of patL. Unlike
+//matchPathSeq, running out of curL before patL is a match (curL just
+//hasn't gone deep enough yet to rule pat out), while running out of
+//patL before curL is not (pat was for a shallower target). Used by
+//JReader's default SelectFunc to skip subtrees no requested path can
+//possibly reach.
+func prefixMayMatch(curL []string, curD []pathNode, ci int, patL []string, patD []pathNode, pi int) bool {
+    if ci == len(curL) {
+        return true
+    }
+    if pi == len(patL) {
+        return false
+    }
+    patNode := patD[pi]
+    patType := patL[pi]
+
+    if patType == "DESCEND" {
+        if prefixMayMatch(curL, curD, ci, patL, patD, pi+1) {
+            return true
+        }
+        return prefixMayMatch(curL, curD, ci+1, patL, patD, pi)
+    }
+
+    if patType != curL[ci] {
+        return false
+    }
+    if !pathNodeMatches(curD[ci], patNode, patType) {
+        return false
+    }
+    return prefixMayMatch(curL, curD, ci+1, patL, patD, pi+1)
+}
+
+//pathNodeMatches checks whether a single concrete node matches a single
+//pattern node of the same type ("ARRAY" or "OBJECT").
+func pathNodeMatches(cur pathNode, pat pathNode, nodeType string) bool {
+    if nodeType == "ARRAY" {
+        if pat.sliceStart != nil || pat.sliceEnd != nil || pat.sliceStep != nil {
+            return indexInSlice(cur.index, pat.sliceStart, pat.sliceEnd, pat.sliceStep)
+        }
+        if pat.unionIndices != nil {
+            for _, idx := range pat.unionIndices {
+                if idx == cur.index {
+                    return true
+                }
+            }
+            return false
+        }
+        if pat.index == -1 {
+            //match any index if pattern has unindexed array []/[*]
+            return true
+        }
+        if pat.index < 0 {
+            //negative index: cannot be resolved against a forward-only
+            //stream position without knowing the array length
+            return false
+        }
+        return cur.index == pat.index
+    } else if nodeType == "OBJECT" {
+        if pat.wildcardKey {
+            return true
+        }
+        return cur.key == pat.key
+    }
+    return true
+}
+
+//indexInSlice reports whether idx falls within a JSONPath slice
+//[start:end:step], using nil bounds as "unbounded" and Python-style
+//defaults (start=0, end=len, step=1).
+func indexInSlice(idx int, start, end, step *int) bool {
+    if idx < 0 {
+        return false //negative index, see NewJSONPath/parseJSONPathBracket
+    }
+    st := 1
+    if step != nil {
+        st = *step
+    }
+    if st == 0 {
+        return false
+    }
+    lo := 0
+    if start != nil {
+        lo = *start
+    }
+    if st > 0 {
+        if idx < lo {
+            return false
+        }
+        if end != nil && idx >= *end {
+            return false
+        }
+        return (idx-lo)%st == 0
+    }
+    //negative step: only meaningful with a known end bound, which we
+    //don't have while streaming; unsupported for now
+    return false
+}
+func (self *PathRef) isArray(i int) bool {
+    return self.pathL[i] == "ARRAY"
+}
+
+//func (self *JReader) inArray() bool {
+//    if len(self.pathL) == 0 {
+//        return false
+//    }
+//    return self.pathL[self.depthIndex()] == "ARRAY"
+//}
+//
+//func (self *JReader) inObject() bool {
+//    if len(self.pathL) == 0 {
+//        return false
+//    }
+//    return self.pathL[self.depthIndex()] == "OBJECT"
+func (self *PathRef) hasIndex(i int) bool {
+    return self.atD[i].index > -1
+}
+
+//predicateGuard is a precomputed (prefix, predicate) pair for a schema
+//path that has a "[?(...)]" where-clause on one of its array segments.
+type predicateGuard struct {
+    prefix *PathRef //path up to and including the predicate-bearing ARRAY
+    predicate predExpr
+}
+
+//bufferedEmit is a result value collected while its enclosing array
+//element is still being buffered for predicate evaluation.
+type bufferedEmit struct {
+    path *PathRef
+    dstKey string
+    value string
+    reqSrc *PathRef
+    isMulti bool
+}
+
+//predFrame tracks one in-flight array element (object) whose emission
+//is deferred until its predicate can be evaluated at object_end.
+type predFrame struct {
+    startDepth int //self.depthIndex() at the object's object_start
+    predicate predExpr
+    fields map[string]interface{} //direct child scalar fields, for @.key refs
+    buffered []bufferedEmit //Read/Stream (string values)
+    bufferedT []bufferedEmitT //ReadTyped/StreamTyped (typed values)
+}
+
+//bufferedEmitT is bufferedEmit for ReadTyped/StreamTyped, where a value
+//is a number, bool, null, string or a captured subtree (see
+//captureSubtree) rather than always a string.
+type bufferedEmitT struct {
+    path *PathRef
+    dstKey string
+    value interface{}
+    reqSrc *PathRef
+    isMulti bool
+}
+
+type JReader struct {
+    filePath string
+    file io.Reader
+    json *json.Decoder
+    res map[string]string
+    pathL []string
+    atD map[int]*pathNode
+    resState resultContainer
+    resStateT resultContainerT //ReadTyped/StreamTyped counterpart of resState
+    schema map[string]string //TODO typedef ...
+    schemaItems []schemaItem
+    srcPathLst []string
+    shortestPathDepthInt int
+    rxMultiMatch *regexp.Regexp
+    reqInfoMap map[string]map[string]string
+    predicateGuards []predicateGuard
+    predFrames []*predFrame
+    //pendingResults/pendingResultsT hold extra results a single predicate
+    //frame flush produced (e.g. 3 matching elements under one "[?(...)]"
+    //guard yielding 3 commits) beyond the one readCtx/readTypedCtx can
+    //return from the call that produced them - see maybeEndPredicateFrame.
+    pendingResults []map[string]string
+    pendingResultsT []map[string]interface{}
+    //AllowIncomplete, when true, makes Read/Stream/Results yield a
+    //partial result instead of failing with ErrIncomplete once the
+    //search area for that result is left.
+    AllowIncomplete bool
+    //Mode selects how the stream is treated once a top-level JSON value
+    //has been fully parsed; see ReadMode. Defaults to ModeSingleDocument.
+    Mode ReadMode
+    docDone bool //set once ModeSingleDocument has consumed its one value
+    //SelectFunc, if set, is consulted on every object/array about to be
+    //entered and decides whether to parse it, skip it without parsing
+    //(see SelectDecision), or stop reading altogether. Without
+    //SelectFunc, a default derived from the schema skips any subtree no
+    //requested path could possibly match below.
+    SelectFunc func(path *PathRef) SelectDecision
+    //OnMissingTransformInput selects what a schema transform expression
+    //(see SetSchema) does when one of the paths it reads was never found
+    //for the current result. Defaults to MissingInputNull.
+    OnMissingTransformInput MissingInputPolicy
+}
+
+//MissingInputPolicy selects how a schema transform expression behaves
+//when one of the paths it reads was never found for the current result,
+//see JReader.OnMissingTransformInput.
+type MissingInputPolicy int
+
+const (
+    //MissingInputNull, the default, resolves a missing transform input to
+    //null/nil, the same as a predicate field reference to an absent key;
+    //built-ins like default(x,y) can then supply a fallback explicitly.
+    MissingInputNull MissingInputPolicy = iota
+    //MissingInputError fails the result with ErrMissingInput instead.
+    MissingInputError
+)
+
+//SelectDecision is returned by JReader.SelectFunc (or the schema-
+//derived default) for an object/array about to be entered.
+type SelectDecision int
+
+const (
+    //Descend parses the subtree normally.
+    Descend SelectDecision = iota
+    //Skip fast-forwards past the subtree without parsing any of it.
+    Skip
+    //Stop ends parsing altogether, as if the input had ended there.
+    Stop
+)
+
+//ReadMode selects how JReader treats the input stream once a top-level
+//JSON value has been fully parsed, see JReader.Mode.
+type ReadMode int
+
+const (
+    //ModeSingleDocument, the default, stops after the first top-level
+    //value: Read/Stream/Results report a clean io.EOF without reading
+    //any further input, same as for a single JSON document.
+    ModeSingleDocument ReadMode = iota
+    //ModeNDJSON continues past a finished top-level value to the next
+    //one, for input consisting of newline-separated JSON values (JSON
+    //Lines / NDJSON); each document yields its own results independently.
+    ModeNDJSON
+    //ModeConcatenated is ModeNDJSON for top-level values with no
+    //separator between them at all (back-to-back JSON documents).
+    ModeConcatenated
+)
+
+//NewJReader opens ifile (or reads stdin for ifile == "-") and returns a
+//JReader ready to have its schema set. ifile == "" returns (nil, nil):
+//no reader is created. A file that fails to open is reported
+//as an error, never by killing the process - see Read/Stream for how
+//other failures surface the same way.
+func NewJReader(ifile string) (*JReader, error) {
+    r := &JReader{}
+    r.filePath = ifile
+
+    if ifile == "" {
+        return nil, nil
+    }
+    //var file *io.Reader
+    if ifile == "-" {
+        r.file = bufio.NewReader(os.Stdin)
+    } else {
+        file, err := os.Open(ifile)
+        if err != nil {
+            return nil, fmt.Errorf("json_extractor: failed to open %s: %w", ifile, err)
+        }
+        r.file = file
+    }
+
+    r.json = json.NewDecoder(r.file)
+
+    r.rxMultiMatch = regexp.MustCompile(`^(.*?)(\[\d+\])$`) //TODO obsolete
+
+    r.init()
+
+    return r, nil
+}
+
+func (self *JReader) SetSchema(userSchema map[string]string) {
+    //TODO typedef or accept alternative input format
+    self.schema = userSchema
+    self.schemaItems = nil
+    addedXformPaths := make(map[string]bool)
+    for k, v := range userSchema {
+        if expr, xformPaths, ok := parseMaybeTransform(v); ok {
+            //A transform expression has no stream location of its own;
+            //it reads the paths it references via the shadow schemaItems
+            //added below, one per distinct path across the whole schema
+            //(two transforms reading the same path share one shadow item;
+            //see xformInputKey) so len(seen)==len(srcPaths()) still holds.
+            self.schemaItems = append(self.schemaItems, schemaItem{DstKey: k, Transform: expr})
+            for _, p := range xformPaths {
+                if addedXformPaths[p.raw] {
+                    continue
+                }
+                addedXformPaths[p.raw] = true
+                self.schemaItems = append(self.schemaItems, schemaItem{ReqPath: p, DstKey: xformInputKey(p.raw)})
+            }
+            continue
+        }
+        newItem := schemaItem{}
+        if strings.HasPrefix(v, "$") {
+            //JSONPath syntax coexists with the bespoke one (NewPath);
+            //a SetSchema caller isn't expected to handle parse errors,
+            //so fall back to a nil (non-matching) ReqPath on failure.
+            reqPath, err := NewJSONPath(v)
+            if err != nil {
+                reqPath = nil
+            }
+            newItem.ReqPath = reqPath
+        } else {
+            newItem.ReqPath = NewPath(v)
+        }
+        newItem.DstKey = k
+        self.schemaItems = append(self.schemaItems, newItem)
+    }
+
+    var paths []string
+    for _, item := range self.schemaItems {
+        if item.ReqPath == nil {
+            continue
+        }
+        paths = append(paths, item.ReqPath.raw)
+    }
+    self.srcPathLst = paths
+
+    var depth int
+    for _, item := range self.schemaItems {
+        if item.ReqPath == nil {
+            continue
+        }
+        var d int
+        if strings.HasPrefix(item.ReqPath.raw, "$") {
+            //JSONPath: no legacy "."-count quirk to preserve
+            d = item.ReqPath.minDepth()
+        } else {
+            //Bespoke syntax: same depth measure as the original parser,
+            //i.e. the raw string's "."-separated segment count, kept for
+            //compatibility (a leading unindexed "[]" yields one fewer
+            //pathL entry than the string has dot-segments).
+            d = len(strings.Split(item.ReqPath.raw, "."))
+        }
+        if depth == 0 || d < depth {
+            depth = d
+        }
+    }
+    self.shortestPathDepthInt = depth
+
+    self.predicateGuards = nil
+    seen := make(map[string]bool)
+    for _, item := range self.schemaItems {
+        if item.ReqPath == nil {
+            continue
+        }
+        for _, guard := range predicateGuardsFor(item.ReqPath) {
+            key := guard.prefix.String()
+            if seen[key] {
+                continue
+            }
+            seen[key] = true
+            self.predicateGuards = append(self.predicateGuards, guard)
+        }
+    }
+
+}
+
+//predicateGuardsFor returns one (prefix, predicate) guard for every
+//"[?(...)]"-bearing ARRAY segment in path, not just the first - a path
+//can nest a predicate-guarded array inside another, e.g.
+//".orders[?(@.status==\"paid\")].items[?(@.qty>1)].name", and each one
+//needs its own frame so both predicates are actually evaluated.
+func predicateGuardsFor(path *PathRef) []predicateGuard {
+    var guards []predicateGuard
+    for i, l := range path.pathL {
+        if l == "ARRAY" && path.atD[i].predicate != nil {
+            prefix := &PathRef{
+                pathL: append([]string(nil), path.pathL[:i+1]...),
+                atD: append([]pathNode(nil), path.atD[:i+1]...),
+            }
+            guards = append(guards, predicateGuard{prefix: prefix, predicate: path.atD[i].predicate})
+        }
+    }
+    return guards
+}
+
+//minDepth returns the minimum concrete depth a path can match at, i.e.
+//the number of segments that aren't recursive-descend ("..") markers.
+//For a path without "..", that's len(pathL), which is not the same as
+//the raw string's len(strings.Split(p, ".")) (".want" gives 1 here and 2
+//there); SetSchema uses that raw-string count for the bespoke syntax.
+func (self *PathRef) minDepth() int {
+    var d int
+    for _, l := range self.pathL {
+        if l != "DESCEND" {
+            d++
+        }
+    }
+    return d
+}
+
+func (self *JReader) init() {
+    self.res = make(map[string]string)
+    self.pathL = nil
+    self.atD = make(map[int]*pathNode)
+    self.resState = resultContainer{} //res stays undefined/nil
+    self.resStateT = resultContainerT{}
+    self.reqInfoMap = make(map[string]map[string]string) //cache
+    self.predFrames = nil
+    self.pendingResults = nil
+    self.pendingResultsT = nil
+}
+
+//afterTopLevelValue is called once a top-level JSON value has fully
+//closed (depth() back to 0). In ModeSingleDocument, it's done - the
+//reader won't read any further input. In ModeNDJSON/ModeConcatenated,
+//it hard-resets all per-document state via init() so the next value
+//starts from a clean slate, and parsing continues.
+func (self *JReader) afterTopLevelValue() {
+    if self.Mode == ModeSingleDocument {
+        self.docDone = true
+        return
+    }
+    self.init()
+}
+
+func (self *JReader) currentPath() *PathRef {
+    path := newPathRef(self.pathL, self.atD)
+    return path
+}
+
+func (self *JReader) depth() int {
+    return len(self.pathL)
+}
+
+func (self *JReader) depthIndex() int {
+    return self.depth() - 1
+}
+
+func (self *JReader) currentNode() *pathNode {
     node := self.atD[self.depthIndex()]
     return node
 }
 
-func (self *JReader) inArray() bool {
-    if len(self.pathL) == 0 {
+func (self *JReader) inArray() bool {
+    if len(self.pathL) == 0 {
+        return false
+    }
+    return self.pathL[self.depthIndex()] == "ARRAY"
+}
+
+func (self *JReader) inObject() bool {
+    if len(self.pathL) == 0 {
+        return false
+    }
+    return self.pathL[self.depthIndex()] == "OBJECT"
+}
+
+func (self *JReader) prune() {
+    for k, _ := range self.atD {
+        if k > self.depthIndex() {
+            delete(self.atD, k)
+        }
+    }
+}
+
+func (self *JReader) handleEvent(ev string) {
+
+    //ev == "doc_start": not implemented
+
+    if ev == "object_start" {
+        //New object
+        self.pathL = append(self.pathL, "OBJECT")
+        var d int = self.depthIndex()
+        self.atD[d] = &pathNode{}
+    } else if ev == "object_end" {
+        self.popLevel()
+    }
+    if ev == "array_start" {
+        //New array
+        self.pathL = append(self.pathL, "ARRAY")
+        //New node (path) element with index = 0
+        self.atD[self.depthIndex()] = &pathNode{}
+    } else if ev == "array_end" {
+        self.popLevel()
+    }
+
+}
+
+//popLevel undoes the pathL/atD push made for the object or array that
+//is now closing, shared by object_end and array_end as well as by the
+//subtree-capture short-circuit in readTypedCtx, which consumes a whole
+//object/array via captureSubtree without going through handleEvent.
+func (self *JReader) popLevel() {
+    //Go one level up
+    self.pathL = self.pathL[:len(self.pathL)-1]
+    //index++ for next array element
+    if self.inArray() {
+        node := self.currentNode()
+        node.index += 1
+    }
+    //Clear position data from previous level (pop stack)
+    self.prune()
+}
+
+//Read parses input up to the next full (or, with AllowIncomplete,
+//partial) result object and returns it. It returns io.EOF once the
+//input is exhausted (or, in the default ModeSingleDocument, once the
+//first top-level value has been fully parsed - see JReader.Mode), or a
+//typed error (ErrCollision, ErrIncomplete, ErrOutOfOrder) if the input
+//doesn't match the schema as expected.
+func (self *JReader) Read() (map[string]string, error) {
+    return self.readCtx(context.Background())
+}
+
+//readCtx is Read with cancellation: ctx is checked before every token is
+//read, so a long walk through an uninteresting subtree can be aborted
+//promptly instead of running to the next match or end of input.
+func (self *JReader) readCtx(ctx context.Context) (map[string]string, error) {
+    if len(self.pendingResults) > 0 {
+        r := self.pendingResults[0]
+        self.pendingResults = self.pendingResults[1:]
+        return r, nil
+    }
+    var result map[string]string
+    for result == nil {
+        if self.docDone {
+            return nil, io.EOF
+        }
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        default:
+        }
+
+        t, err := self.json.Token()
+        if err == io.EOF {
+            return nil, io.EOF
+        } else if err != nil {
+            return nil, errors.New("read error")
+        }
+
+        //Event
+        var ev string
+        var value string //interface{}
+        switch v := t.(type) {
+            case json.Delim:
+            t := v.String()
+            if t == "{" {
+                ev = "object_start"
+            } else if t == "}" {
+                ev = "object_end"
+            } else if t == "[" {
+                ev = "array_start"
+            } else if t == "]" {
+                ev = "array_end"
+            }
+            case string:
+            if self.inObject() {
+                node := self.currentNode()
+                if len(node.key) == 0 { //we don't allow blank keys
+                    ev = "key"
+                } else {
+                    ev = "value"
+                }
+            } else {
+                ev = "value"
+            }
+            value = v
+            default:
+            //float64, bool or nil (JSON number, boolean or null),
+            //stringified the same way predicate comparisons do (see
+            //predAsString) so Read/Stream/Results can yield them at all -
+            //previously only string-valued JSON reached setValue here and
+            //every number/bool/null in the input was silently dropped.
+            ev = "value"
+            value = predAsString(v)
+        }
+
+        //Update stack
+        self.handleEvent(ev)
+
+        //SelectFunc/defaultSelect: decide whether this subtree is even
+        //worth parsing before doing anything else with it.
+        if ev == "object_start" || ev == "array_start" {
+            switch self.selectDecision(self.currentPath()) {
+            case Stop:
+                self.docDone = true
+                return nil, io.EOF
+            case Skip:
+                delim := json.Delim('{')
+                if ev == "array_start" {
+                    delim = json.Delim('[')
+                }
+                if err := skipSubtree(ctx, self.json, delim); err != nil {
+                    return nil, err
+                }
+                self.popLevel()
+                if self.inObject() {
+                    self.currentNode().key = ""
+                }
+                if r, err := self.checkClearRes(); err != nil {
+                    return nil, err
+                } else if r != nil {
+                    result = r
+                }
+                if self.depth() == 0 {
+                    self.afterTopLevelValue()
+                }
+                continue
+            }
+        }
+
+        if r, err := self.handlePredicateFrames(ev); err != nil {
+            return nil, err
+        } else if r != nil {
+            result = r
+        }
+        if r, err := self.checkClearRes(); err != nil {
+            return nil, err
+        } else if r != nil {
+            result = r
+        }
+
+        //Node key (object)
+        if ev == "key" {
+            node := self.currentNode()
+            node.key = value
+        }
+        //Node element, value
+        if ev == "value" {
+            self.recordPredicateField(value)
+            if r, err := self.setValue(value); err != nil {
+                return nil, err
+            } else if r != nil {
+                result = r
+            }
+            if self.inArray() {
+                node := self.currentNode()
+                node.index += 1
+            }
+            if self.inObject() {
+                self.currentNode().key = ""
+            }
+        }
+
+        if self.depth() == 0 {
+            self.afterTopLevelValue()
+        }
+    }
+
+    return result, nil
+}
+
+//Stream parses input, invoking cb once per result object (see Read for
+//what a "result" is), until input is exhausted, cb returns an error, ctx
+//is cancelled, or a parse error occurs. It returns nil on clean EOF.
+func (self *JReader) Stream(ctx context.Context, cb func(map[string]string) error) error {
+    for {
+        result, err := self.readCtx(ctx)
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        if err := cb(result); err != nil {
+            return err
+        }
+    }
+}
+
+//Results is a channel-based variant of Stream: it parses input in a
+//background goroutine, sending each result object on the first channel.
+//A parse error (other than clean EOF) is sent on the second channel;
+//both channels are closed once the goroutine returns.
+func (self *JReader) Results() (<-chan map[string]string, <-chan error) {
+    resultsCh := make(chan map[string]string)
+    errCh := make(chan error, 1)
+
+    go func() {
+        defer close(resultsCh)
+        defer close(errCh)
+        for {
+            result, err := self.Read()
+            if err == io.EOF {
+                return
+            } else if err != nil {
+                errCh <- err
+                return
+            }
+            resultsCh <- result
+        }
+    }()
+
+    return resultsCh, errCh
+}
+
+//handlePredicateFrames opens/resolves the buffering of an array element
+//guarded by a "[?(...)]" predicate; see setValue and commitValue.
+func (self *JReader) handlePredicateFrames(ev string) (map[string]string, error) {
+    if ev == "object_start" {
+        self.maybeStartPredicateFrame()
+        return nil, nil
+    }
+    if ev == "object_end" {
+        return self.maybeEndPredicateFrame()
+    }
+    return nil, nil
+}
+
+func (self *JReader) topPredicateFrame() *predFrame {
+    if len(self.predFrames) == 0 {
+        return nil
+    }
+    return self.predFrames[len(self.predFrames)-1]
+}
+
+//maybeStartPredicateFrame starts buffering the object just opened if it
+//is itself an element of a predicate-guarded array.
+func (self *JReader) maybeStartPredicateFrame() {
+    if len(self.predicateGuards) == 0 {
+        return
+    }
+    //The object just opened is the last entry of the current path; the
+    //guard's prefix describes the array it's an element of, i.e. the
+    //path without that trailing object.
+    cur := self.currentPath()
+    parent := &PathRef{
+        pathL: cur.pathL[:len(cur.pathL)-1],
+        atD: cur.atD[:len(cur.atD)-1],
+    }
+    for _, guard := range self.predicateGuards {
+        if parent.matches(guard.prefix) {
+            self.predFrames = append(self.predFrames, &predFrame{
+                startDepth: self.depthIndex(),
+                predicate: guard.predicate,
+                fields: make(map[string]interface{}),
+            })
+            return //one frame per object; first matching guard wins
+        }
+    }
+}
+
+//maybeEndPredicateFrame closes the buffering frame if the object that
+//just ended was the one that opened it, evaluating its predicate and
+//either discarding or committing (or re-deferring to an outer frame)
+//the values collected while it was open.
+func (self *JReader) maybeEndPredicateFrame() (map[string]string, error) {
+    top := self.topPredicateFrame()
+    if top == nil || self.depthIndex() != top.startDepth-1 {
+        return nil, nil
+    }
+    self.predFrames = self.predFrames[:len(self.predFrames)-1]
+
+    pass, err := top.predicate.eval(top.fields)
+    if err != nil || !predTruthy(pass) {
+        return nil, nil //predicate false (or not resolvable) - discard element
+    }
+
+    if outer := self.topPredicateFrame(); outer != nil {
+        outer.buffered = append(outer.buffered, top.buffered...)
+        return nil, nil
+    }
+
+    var result map[string]string
+    for _, b := range top.buffered {
+        r, err := self.commitValue(b.path, b.dstKey, b.value, b.reqSrc, b.isMulti)
+        if err != nil {
+            return nil, err
+        }
+        if r == nil {
+            continue
+        }
+        if result == nil {
+            result = r
+        } else {
+            self.pendingResults = append(self.pendingResults, r)
+        }
+    }
+    return result, nil
+}
+
+//recordPredicateField remembers a direct scalar field of the object
+//currently being buffered for predicate evaluation, so "@.key" and
+//"@['key']" references can resolve once the object closes.
+func (self *JReader) recordPredicateField(value interface{}) {
+    top := self.topPredicateFrame()
+    if top == nil || self.depthIndex() != top.startDepth {
+        return
+    }
+    top.fields[self.currentNode().key] = value
+}
+
+func (self *JReader) checkClearRes() (map[string]string, error) {
+    //Check if we're above all requested paths
+    //Once we are, the current result object must either be empty or full;
+    //new matches belong to the next result object.
+    d0 := self.shortestPathDepth() //shortest req path, i.e., boundary
+    //d0 has one additional item for doc_start lol
+    if self.depth() >= d0 - 1 {
+        return nil, nil //we're within the search area for a single object
+    }
+    path := self.currentPath()
+
+    //Nothing to do if current result object empty
+    if len(self.resState.result) == 0 {
+        return nil, nil
+    }
+
+    //Check if current result object incomplete
+    if !self.isFull() {
+        //Incomplete result, not all requested keys found
+        result := self.resState.result
+        seen := self.resState.seen
+        self.resState = resultContainer{}
+        self.checkFull()
+        if self.AllowIncomplete {
+            if self.hasTransforms() {
+                if err := self.finalizeTransformsString(result); err != nil {
+                    return nil, err
+                }
+            }
+            return result, nil
+        }
+        return nil, fmt.Errorf("%w at %s; seen only: %s", ErrIncomplete, path.String(), seen)
+    }
+
+    //Check for skipped elements
+    if len(self.resState.skipped) > 0 {
+        self.resState = resultContainer{}
+        self.checkFull()
+        return nil, fmt.Errorf("%w at %s", ErrOutOfOrder, path.String())
+    }
+
+    //Reset result after we've left the req/search area
+    //(full result has already been yielded in setValue)
+    self.resState = resultContainer{}
+    self.checkFull()
+
+    return nil, nil
+}
+
+func (self *JReader) srcPaths() []string {
+    return self.srcPathLst
+}
+
+func (self *JReader) shortestPathDepth() int {
+    return self.shortestPathDepthInt
+}
+
+func (self *JReader) pathMatches(reqPath, cmpPath string) bool {
+    reqPathParts := strings.Split(reqPath, ".") //requested path or pattern
+    pathModParts := strings.Split(cmpPath, ".")
+    if len(reqPathParts) != len(pathModParts) {
         return false
     }
-    return self.pathL[self.depthIndex()] == "ARRAY"
-}
+    var cmpPathMod string
+    j := -1
+    for i, part := range pathModParts {
+        j += 1
+        if j > 0 {
+            cmpPathMod += "."
+        }
+        partMod := part
+        reqPart := reqPathParts[i]
+        if len(reqPart) > 1 && reqPart[len(reqPart)-2:] == "[]" {
+            multiMatch := self.rxMultiMatch.FindStringSubmatch(partMod)
+            if len(multiMatch) > 2 {
+                partMod = multiMatch[1] + "[]"
+            }
+        }
+        cmpPathMod += partMod
+    }
+
+    return reqPath == cmpPathMod
+}
+
+func (self *JReader) checkFull() bool {
+    foundAllKeys := true
+    for _, src := range self.srcPaths() {
+        srcSeen := false
+        for _, v := range self.resState.seen {
+            if v.String() == src {
+                srcSeen = true
+            }
+        }
+        if !srcSeen {
+            foundAllKeys = false
+            break
+        }
+    }
+    self.resState.fullState = foundAllKeys
+    return self.isFull()
+}
+
+func (self *JReader) isFull() bool {
+    return self.resState.fullState
+}
+
+func (self *JReader) reqPath(cmpPath *PathRef) *schemaItem {
+    //Return info about requested path or nothing if path not requested
+    //cmpPath references absolute path like .[0].List[8]
+    for _, schemaItem := range self.schemaItems {
+        //NOTE when comparing absolute vs dynamic path, right/other = dynamic
+        if schemaItem.ReqPath == nil {
+            continue //failed to parse, e.g. a bad JSONPath expression
+        }
+        if cmpPath.matches(schemaItem.ReqPath) {
+            return &schemaItem
+        }
+    }
+
+    return nil
+}
+//TODO Check for partial match while building path
+
+func (self *JReader) isPathRequested(path *PathRef) bool {
+    return self.reqPath(path) != nil
+}
+
+//selectDecision consults SelectFunc for path, an object/array just
+//entered, falling back to defaultSelect if none is set.
+func (self *JReader) selectDecision(path *PathRef) SelectDecision {
+    if self.SelectFunc != nil {
+        return self.SelectFunc(path)
+    }
+    return self.defaultSelect(path)
+}
+
+//defaultSelect skips path unless some requested schema path could still
+//match it or something below it. path's own last level was just pushed
+//and isn't identified yet (an OBJECT's key is only known once its "key"
+//token is read), so the comparison is against its parent, asking
+//whether *some* child of it (any key/index) could still lead to a match.
+func (self *JReader) defaultSelect(path *PathRef) SelectDecision {
+    parentL := path.pathL[:len(path.pathL)-1]
+    parentD := path.atD[:len(path.atD)-1]
+    for _, item := range self.schemaItems {
+        if item.ReqPath == nil {
+            continue
+        }
+        if prefixMayMatch(parentL, parentD, 0, item.ReqPath.pathL, item.ReqPath.atD, 0) {
+            return Descend
+        }
+    }
+    return Skip
+}
+
+//applyTransforms evaluates every Transform-bearing schemaItem (see
+//SetSchema) against env, which holds the paths they read under
+//xformInputKey, and returns their DstKey -> computed value pairs. It
+//doesn't mutate env or strip anything from it - see stripXformInputsString
+//and stripXformInputsT for
+//that, done separately once the caller's own (string or typed) result map
+//has the computed values merged in.
+func (self *JReader) applyTransforms(env map[string]interface{}) (map[string]interface{}, error) {
+    var computed map[string]interface{}
+    for _, item := range self.schemaItems {
+        if item.Transform == nil {
+            continue
+        }
+        if self.OnMissingTransformInput == MissingInputError {
+            if missing := firstMissingTransformInput(item.Transform, env); missing != "" {
+                return nil, fmt.Errorf("%w: %s needs %s", ErrMissingInput, item.DstKey, missing)
+            }
+        }
+        v, err := item.Transform.eval(env)
+        if err != nil {
+            return nil, fmt.Errorf("transform for %q: %w", item.DstKey, err)
+        }
+        if computed == nil {
+            computed = make(map[string]interface{})
+        }
+        computed[item.DstKey] = v
+    }
+    return computed, nil
+}
+
+//hasTransforms reports whether SetSchema compiled any transform
+//expressions, so callers can skip applyTransforms and the
+//stripXformInputsString/stripXformInputsT step entirely on the (common) plain-path-only schema.
+func (self *JReader) hasTransforms() bool {
+    for _, item := range self.schemaItems {
+        if item.Transform != nil {
+            return true
+        }
+    }
+    return false
+}
+
+func stripXformInputsString(result map[string]string) {
+    for k := range result {
+        if strings.HasPrefix(k, xformInputPrefix) {
+            delete(result, k)
+        }
+    }
+}
+
+//finalizeTransformsString runs applyTransforms against result (a Read/
+//Stream result, string-valued), writing the computed values back in
+//(stringified - see predAsString) under their DstKey, and removes the
+//raw path inputs the transforms read (see xformInputKey) so they never
+//show up in the result the caller sees.
+func (self *JReader) finalizeTransformsString(result map[string]string) error {
+    env := make(map[string]interface{}, len(result))
+    for k, v := range result {
+        env[k] = v
+    }
+    computed, err := self.applyTransforms(env)
+    if err != nil {
+        return err
+    }
+    stripXformInputsString(result)
+    for k, v := range computed {
+        result[k] = predAsString(v)
+    }
+    return nil
+}
+
+//finalizeTransformsT is finalizeTransformsString for ReadTyped/
+//StreamTyped, where the computed value keeps its native type instead of
+//being stringified.
+func (self *JReader) finalizeTransformsT(result map[string]interface{}) error {
+    computed, err := self.applyTransforms(result)
+    if err != nil {
+        return err
+    }
+    stripXformInputsT(result)
+    for k, v := range computed {
+        result[k] = v
+    }
+    return nil
+}
+
+func stripXformInputsT(result map[string]interface{}) {
+    for k := range result {
+        if strings.HasPrefix(k, xformInputPrefix) {
+            delete(result, k)
+        }
+    }
+}
+
+func (self *JReader) setValue(value string) (map[string]string, error) {
+    //Handle value, update result object...
+
+    //Skip if current element path not on list of requested paths
+    path := self.currentPath()
+    req := self.reqPath(path)
+    if !self.isPathRequested(path) {
+        return nil, nil
+    }
+    reqSrc := req.ReqPath
+    dstKey := req.DstKey //TODO method
+    isMulti := req.IsMulti()
+
+    //A value found inside an array element that's still being buffered
+    //for a "[?(...)]" predicate can't be committed yet - the predicate
+    //might suppress the whole element once it closes.
+    if frame := self.topPredicateFrame(); frame != nil {
+        frame.buffered = append(frame.buffered, bufferedEmit{path: path, dstKey: dstKey, value: value, reqSrc: reqSrc, isMulti: isMulti})
+        return nil, nil
+    }
+
+    return self.commitValue(path, dstKey, value, reqSrc, isMulti)
+}
+
+//commitValue adds a found value to the current result object, exactly
+//as setValue used to do directly, and yields the result once complete.
+func (self *JReader) commitValue(path *PathRef, dstKey string, value string, reqSrc *PathRef, isMulti bool) (map[string]string, error) {
+    //Prepare result object, "seen" list for found keys
+    //Remember path to beginning of result object
+    markedSkipped := false
+    resContainer := &self.resState
+    if resContainer.result == nil {
+        resContainer.result = make(map[string]string)
+        //resContainer.p0 = path //...
+    }
+    result := resContainer.result
+    //Check for collision (already found), fatal only for absolute path
+    //NOTE we might skip items if collisions are not recognized properly
+    if _, ok := result[dstKey]; ok {
+        if isMulti {
+            //skip element at: path
+            resContainer.skipped = append(resContainer.skipped, path)
+            markedSkipped = true
+        } else {
+            //Regular req key already found - collision
+            return nil, fmt.Errorf("%w at %s", ErrCollision, path.String())
+        }
+    }
+
+    //Add value to result object, add path to "seen" list for result
+    result[dstKey] = value
+    resContainer.seen = append(resContainer.seen, reqSrc)
+    //self.checkFull()
+    if len(resContainer.seen) == len(self.srcPaths()) {
+        self.resState.fullState = true
+    }
+
+    //Check if result object is complete
+    if self.isFull() {
+        if markedSkipped {
+            resContainer.skipped = resContainer.skipped[:len(resContainer.skipped)-1]
+        }
+        out := result
+        if isMulti {
+            //resContainer.result keeps accumulating - a multi path (an
+            //unindexed array, wildcard key, or descend) can still produce
+            //more matches within the same req area, overwriting dstKey in
+            //place. Hand the caller its own copy so an earlier yield isn't
+            //silently rewritten by a later match sharing the same map.
+            out = cloneResultString(result)
+        }
+        if self.hasTransforms() {
+            if err := self.finalizeTransformsString(out); err != nil {
+                return nil, err
+            }
+        }
+        //Yield result
+        return out, nil
+        //NOT clearing and resetting here - there could be more
+        //(more matches with collected values within req area)
+        //see also (for clear/yield): checkClearRes()
+    }
 
-func (self *JReader) inObject() bool {
-    if len(self.pathL) == 0 {
-        return false
-    }
-    return self.pathL[self.depthIndex()] == "OBJECT"
+    return nil, nil
 }
 
-func (self *JReader) prune() {
-    for k, _ := range self.atD {
-        if k > self.depthIndex() {
-            delete(self.atD, k)
-        }
+//cloneResultString returns a shallow copy of result, used so a yielded
+//multi-match result doesn't alias resContainer.result and get silently
+//rewritten by a later match of the same multi path.
+func cloneResultString(result map[string]string) map[string]string {
+    out := make(map[string]string, len(result))
+    for k, v := range result {
+        out[k] = v
     }
+    return out
 }
 
-func (self *JReader) handleEvent(ev string) {
 
-    //ev == "doc_start": not implemented
+//ReadTyped is Read, but values keep their native JSON type instead of
+//always being a string: numbers become float64, booleans stay bool,
+//"null" becomes nil, and a requested path that resolves to a whole
+//object or array is captured as map[string]interface{} / []interface{}
+//(see captureSubtree) rather than being silently ignored.
+func (self *JReader) ReadTyped() (map[string]interface{}, error) {
+    return self.readTypedCtx(context.Background())
+}
 
-    if ev == "object_start" {
-        //New object
-        self.pathL = append(self.pathL, "OBJECT")
-        var d int = self.depthIndex()
-        self.atD[d] = &pathNode{}
-    } else if ev == "object_end" {
-        //Go one level up
-        self.pathL = self.pathL[:len(self.pathL)-1]
-        //index++ for next array element
-        if self.inArray() {
-            node := self.currentNode()
-            node.index += 1
-        }
-        //Clear position data from previous level (pop stack)
-        self.prune()
+//readTypedCtx is ReadTyped with cancellation, see readCtx.
+func (self *JReader) readTypedCtx(ctx context.Context) (map[string]interface{}, error) {
+    if len(self.pendingResultsT) > 0 {
+        r := self.pendingResultsT[0]
+        self.pendingResultsT = self.pendingResultsT[1:]
+        return r, nil
     }
-    if ev == "array_start" {
-        //New array
-        self.pathL = append(self.pathL, "ARRAY")
-        //New node (path) element with index = 0
-        self.atD[self.depthIndex()] = &pathNode{}
-    } else if ev == "array_end" {
-        //Go one level up
-        self.pathL = self.pathL[:len(self.pathL)-1]
-        //index++ for next array element
-        if self.inArray() {
-            node := self.currentNode()
-            node.index += 1
+    var result map[string]interface{}
+    for result == nil {
+        if self.docDone {
+            return nil, io.EOF
+        }
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        default:
         }
-        //Clear position data from previous level (pop stack)
-        self.prune()
-    }
-
-}
 
-func (self *JReader) Read() (map[string]string, error) {
-    var result map[string]string
-    for result == nil {
         t, err := self.json.Token()
         if err == io.EOF {
             return nil, io.EOF
@@ -388,17 +2778,17 @@ func (self *JReader) Read() (map[string]string, error) {
 
         //Event
         var ev string
-        var value string //interface{}
+        var value interface{}
         switch v := t.(type) {
             case json.Delim:
-            t := v.String()
-            if t == "{" {
+            d := v.String()
+            if d == "{" {
                 ev = "object_start"
-            } else if t == "}" {
+            } else if d == "}" {
                 ev = "object_end"
-            } else if t == "[" {
+            } else if d == "[" {
                 ev = "array_start"
-            } else if t == "]" {
+            } else if d == "]" {
                 ev = "array_end"
             }
             case string:
@@ -413,23 +2803,140 @@ func (self *JReader) Read() (map[string]string, error) {
                 ev = "value"
             }
             value = v
-            //default:
-            //value = fmt.Sprintf("%v", t)
-            //other types not implemented
+            default:
+            //float64, bool or nil (JSON number, boolean or null)
+            ev = "value"
+            value = t
         }
 
         //Update stack
         self.handleEvent(ev)
-        self.checkClearRes()
+
+        //SelectFunc/defaultSelect: decide whether this subtree is even
+        //worth parsing before doing anything else with it.
+        if ev == "object_start" || ev == "array_start" {
+            switch self.selectDecision(self.currentPath()) {
+            case Stop:
+                self.docDone = true
+                return nil, io.EOF
+            case Skip:
+                delim := json.Delim('{')
+                if ev == "array_start" {
+                    delim = json.Delim('[')
+                }
+                if err := skipSubtree(ctx, self.json, delim); err != nil {
+                    return nil, err
+                }
+                self.popLevel()
+                if self.inObject() {
+                    self.currentNode().key = ""
+                }
+                if r, err := self.checkClearResT(); err != nil {
+                    return nil, err
+                } else if r != nil {
+                    result = r
+                }
+                if self.depth() == 0 {
+                    self.afterTopLevelValue()
+                }
+                continue
+            }
+        }
+
+        if ev == "object_start" {
+            self.maybeStartPredicateFrame()
+        }
+
+        //A requested path resolving to an object or array: capture the
+        //whole subtree instead of descending field by field.
+        if ev == "object_start" || ev == "array_start" {
+            //The path of "this key's value" is the parent's own path
+            //(pathL/atD without the level just pushed for this
+            //container), exactly like a scalar value's path - it never
+            //gets a pathL entry of its own, see handleEvent/setValue.
+            cur := self.currentPath()
+            path := &PathRef{
+                pathL: cur.pathL[:len(cur.pathL)-1],
+                atD: cur.atD[:len(cur.atD)-1],
+            }
+            if req := self.reqPath(path); req != nil {
+                delim := json.Delim('{')
+                if ev == "array_start" {
+                    delim = json.Delim('[')
+                }
+                captured, cerr := captureSubtree(ctx, self.json, delim)
+                if cerr != nil {
+                    return nil, cerr
+                }
+                self.popLevel()
+                self.recordPredicateField(captured)
+                r, err := self.bufferOrCommitT(path, req.DstKey, captured, req.ReqPath, req.IsMulti())
+                if err != nil {
+                    return nil, err
+                } else if r != nil {
+                    result = r
+                }
+                //Other schema entries may request a path nested under the
+                //one just captured whole (e.g. "obj": ".data" alongside
+                //"x": ".data.x") - field-by-field matching never runs for
+                //them since captureSubtree already consumed the tokens, so
+                //resolve them directly against the captured value.
+                nestedItems, nestedValues, nerr := self.resolveNestedUnderCapture(path, captured)
+                if nerr != nil {
+                    return nil, nerr
+                }
+                for i, nitem := range nestedItems {
+                    r, err := self.bufferOrCommitT(nitem.ReqPath, nitem.DstKey, nestedValues[i], nitem.ReqPath, nitem.IsMulti())
+                    if err != nil {
+                        return nil, err
+                    } else if r != nil {
+                        result = r
+                    }
+                }
+                if self.inObject() {
+                    self.currentNode().key = ""
+                }
+                if r, err := self.maybeEndPredicateFrameT(); err != nil {
+                    return nil, err
+                } else if r != nil {
+                    result = r
+                }
+                if r, err := self.checkClearResT(); err != nil {
+                    return nil, err
+                } else if r != nil {
+                    result = r
+                }
+                if self.depth() == 0 {
+                    self.afterTopLevelValue()
+                }
+                continue
+            }
+        }
+
+        if ev == "object_end" {
+            if r, err := self.maybeEndPredicateFrameT(); err != nil {
+                return nil, err
+            } else if r != nil {
+                result = r
+            }
+        }
+        if r, err := self.checkClearResT(); err != nil {
+            return nil, err
+        } else if r != nil {
+            result = r
+        }
 
         //Node key (object)
         if ev == "key" {
             node := self.currentNode()
-            node.key = value
+            node.key = value.(string)
         }
         //Node element, value
         if ev == "value" {
-            if r := self.setValue(value); r != nil {
+            self.recordPredicateField(value)
+            if r, err := self.setValueT(value); err != nil {
+                return nil, err
+            } else if r != nil {
                 result = r
             }
             if self.inArray() {
@@ -441,88 +2948,310 @@ func (self *JReader) Read() (map[string]string, error) {
             }
         }
 
+        if self.depth() == 0 {
+            self.afterTopLevelValue()
+        }
     }
 
     return result, nil
 }
 
-func (self *JReader) checkClearRes() {
-    //Check if we're above all requested paths
-    //Once we are, the current result object must either be empty or full;
-    //new matches belong to the next result object.
-    d0 := self.shortestPathDepth() //shortest req path, i.e., boundary
-    //d0 has one additional item for doc_start lol
-    if self.depth() >= d0 - 1 {
-        return //we're within the search area for a single object
+//StreamTyped is Stream for ReadTyped.
+func (self *JReader) StreamTyped(ctx context.Context, cb func(map[string]interface{}) error) error {
+    for {
+        result, err := self.readTypedCtx(ctx)
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        if err := cb(result); err != nil {
+            return err
+        }
     }
-    path := self.currentPath()
+}
 
-    //Nothing to do if current result object empty
-    if len(self.resState.result) == 0 {
-        return
+//skipSubtree fast-forwards dec past a whole JSON object or array,
+//given that its opening delim was already consumed, without building
+//up any value for it - just a depth counter over Token(). This is what
+//lets SelectFunc/defaultSelect skip uninteresting subtrees cheaply.
+//ctx is checked once per token so cancelling it stops a skip over a huge
+//subtree promptly instead of only once the subtree is fully consumed.
+func skipSubtree(ctx context.Context, dec *json.Decoder, open json.Delim) error {
+    depth := 1
+    for depth > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        default:
+        }
+        t, err := dec.Token()
+        if err != nil {
+            return err
+        }
+        if d, ok := t.(json.Delim); ok {
+            switch d {
+            case json.Delim('{'), json.Delim('['):
+                depth++
+            case json.Delim('}'), json.Delim(']'):
+                depth--
+            }
+        }
     }
+    return nil
+}
 
-    //Check if current result object incomplete
-    if !self.isFull() {
-        //Incomplete result, not all requested keys found
-        //TODO if allow_incomplete_result: send/yield?
-        fmt.Printf("ERROR - incomplete result object at %s; seen only: %s\n", path.String(), self.resState.seen)
-        os.Exit(3)
+//captureSubtree reassembles a whole JSON object or array as
+//map[string]interface{} / []interface{}, given that its opening delim
+//was already consumed from dec. It's how ReadTyped captures a requested
+//path that resolves to a container instead of a scalar. ctx is checked
+//once per token, same as skipSubtree, so cancelling it stops a capture of
+//a huge subtree promptly.
+func captureSubtree(ctx context.Context, dec *json.Decoder, open json.Delim) (interface{}, error) {
+    if open == json.Delim('{') {
+        obj := make(map[string]interface{})
+        for {
+            select {
+            case <-ctx.Done():
+                return nil, ctx.Err()
+            default:
+            }
+            t, err := dec.Token()
+            if err != nil {
+                return nil, err
+            }
+            if d, ok := t.(json.Delim); ok && d == json.Delim('}') {
+                return obj, nil
+            }
+            key, _ := t.(string)
+            vt, err := dec.Token()
+            if err != nil {
+                return nil, err
+            }
+            val, err := captureValue(ctx, dec, vt)
+            if err != nil {
+                return nil, err
+            }
+            obj[key] = val
+        }
     }
 
-    //Check for skipped elements
-    if len(self.resState.skipped) > 0 {
-        fmt.Printf("ERROR - skipped elements at at %s (input out of order?)\n", path.String())
-        os.Exit(3)
+    arr := []interface{}{}
+    for {
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        default:
+        }
+        t, err := dec.Token()
+        if err != nil {
+            return nil, err
+        }
+        if d, ok := t.(json.Delim); ok && d == json.Delim(']') {
+            return arr, nil
+        }
+        val, err := captureValue(ctx, dec, t)
+        if err != nil {
+            return nil, err
+        }
+        arr = append(arr, val)
     }
+}
 
-    //Reset result after we've left the req/search area
-    //(full result has already been yielded in setValue)
-    self.resState = resultContainer{}
-    self.checkFull()
+//captureValue resolves one already-read token into a scalar or, if it's
+//an opening delim, recurses into captureSubtree.
+func captureValue(ctx context.Context, dec *json.Decoder, t json.Token) (interface{}, error) {
+    if d, ok := t.(json.Delim); ok && (d == json.Delim('{') || d == json.Delim('[')) {
+        return captureSubtree(ctx, dec, d)
+    }
+    return t, nil
+}
+
+//resolveNestedUnderCapture finds schema items whose requested path is a
+//concrete descendant of containerPath (the path of an object/array just
+//captured whole via captureSubtree, see readTypedCtx) and resolves each
+//one's value directly out of the already-captured value, since normal
+//field-by-field matching never runs for anything under a captured
+//subtree. A nested path that isn't concrete (it crosses a wildcard key,
+//slice, union, predicate or recursive descend) can't be resolved this
+//way and yields ErrOverlappingCapture rather than silently being
+//dropped.
+func (self *JReader) resolveNestedUnderCapture(containerPath *PathRef, captured interface{}) ([]schemaItem, []interface{}, error) {
+    var items []schemaItem
+    var values []interface{}
+    for _, item := range self.schemaItems {
+        if item.ReqPath == nil {
+            continue
+        }
+        suffixL, suffixD, found := nestedCaptureSuffix(containerPath, item.ReqPath)
+        if !found {
+            continue
+        }
+        if !isConcreteSuffix(suffixL, suffixD) {
+            return nil, nil, fmt.Errorf("%w: %s", ErrOverlappingCapture, item.ReqPath.String())
+        }
+        v, ok := navigateCaptured(captured, suffixL, suffixD)
+        if !ok {
+            continue //not present in this particular captured value
+        }
+        items = append(items, item)
+        values = append(values, v)
+    }
+    return items, values, nil
+}
 
+//nestedCaptureSuffix reports whether reqPath is strictly deeper than
+//containerPath and containerPath's segments concretely match reqPath's
+//corresponding prefix, returning the remaining segments of reqPath
+//beyond containerPath.
+func nestedCaptureSuffix(containerPath, reqPath *PathRef) (suffixL []string, suffixD []pathNode, found bool) {
+    n := len(containerPath.pathL)
+    if len(reqPath.pathL) <= n {
+        return nil, nil, false
+    }
+    for i := 0; i < n; i++ {
+        if containerPath.pathL[i] != reqPath.pathL[i] || reqPath.pathL[i] == "DESCEND" {
+            return nil, nil, false
+        }
+        if !pathNodeMatches(containerPath.atD[i], reqPath.atD[i], containerPath.pathL[i]) {
+            return nil, nil, false
+        }
+    }
+    return reqPath.pathL[n:], reqPath.atD[n:], true
 }
 
-func (self *JReader) srcPaths() []string {
-    return self.srcPathLst
+//isConcreteSuffix reports whether suffixL/suffixD consists only of plain
+//object keys and plain array indices - the only kind of path
+//resolveNestedUnderCapture can walk through an already-captured value.
+func isConcreteSuffix(suffixL []string, suffixD []pathNode) bool {
+    for i, l := range suffixL {
+        node := suffixD[i]
+        switch l {
+        case "OBJECT":
+            if node.wildcardKey {
+                return false
+            }
+        case "ARRAY":
+            if node.index < 0 || node.sliceStart != nil || node.sliceEnd != nil ||
+                node.sliceStep != nil || node.unionIndices != nil || node.predicate != nil {
+                return false
+            }
+        default: //"DESCEND"
+            return false
+        }
+    }
+    return true
 }
 
-func (self *JReader) shortestPathDepth() int {
-    return self.shortestPathDepthInt
+//navigateCaptured walks v (as produced by captureSubtree) along a
+//concrete suffix path, returning the nested value it reaches.
+func navigateCaptured(v interface{}, suffixL []string, suffixD []pathNode) (interface{}, bool) {
+    if len(suffixL) == 0 {
+        return v, true
+    }
+    node := suffixD[0]
+    switch suffixL[0] {
+    case "OBJECT":
+        m, ok := v.(map[string]interface{})
+        if !ok {
+            return nil, false
+        }
+        child, ok := m[node.key]
+        if !ok {
+            return nil, false
+        }
+        return navigateCaptured(child, suffixL[1:], suffixD[1:])
+    case "ARRAY":
+        arr, ok := v.([]interface{})
+        if !ok || node.index >= len(arr) {
+            return nil, false
+        }
+        return navigateCaptured(arr[node.index], suffixL[1:], suffixD[1:])
+    }
+    return nil, false
 }
 
-func (self *JReader) pathMatches(reqPath, cmpPath string) bool {
-    reqPathParts := strings.Split(reqPath, ".") //requested path or pattern
-    pathModParts := strings.Split(cmpPath, ".")
-    if len(reqPathParts) != len(pathModParts) {
-        return false
+//maybeEndPredicateFrameT is maybeEndPredicateFrame for ReadTyped.
+func (self *JReader) maybeEndPredicateFrameT() (map[string]interface{}, error) {
+    top := self.topPredicateFrame()
+    if top == nil || self.depthIndex() != top.startDepth-1 {
+        return nil, nil
     }
-    var cmpPathMod string
-    j := -1
-    for i, part := range pathModParts {
-        j += 1
-        if j > 0 {
-            cmpPathMod += "."
+    self.predFrames = self.predFrames[:len(self.predFrames)-1]
+
+    pass, err := top.predicate.eval(top.fields)
+    if err != nil || !predTruthy(pass) {
+        return nil, nil //predicate false (or not resolvable) - discard element
+    }
+
+    if outer := self.topPredicateFrame(); outer != nil {
+        outer.bufferedT = append(outer.bufferedT, top.bufferedT...)
+        return nil, nil
+    }
+
+    var result map[string]interface{}
+    for _, b := range top.bufferedT {
+        r, err := self.commitValueT(b.path, b.dstKey, b.value, b.reqSrc, b.isMulti)
+        if err != nil {
+            return nil, err
         }
-        partMod := part
-        reqPart := reqPathParts[i]
-        if len(reqPart) > 1 && reqPart[len(reqPart)-2:] == "[]" {
-            multiMatch := self.rxMultiMatch.FindStringSubmatch(partMod)
-            if len(multiMatch) > 2 {
-                partMod = multiMatch[1] + "[]"
+        if r == nil {
+            continue
+        }
+        if result == nil {
+            result = r
+        } else {
+            self.pendingResultsT = append(self.pendingResultsT, r)
+        }
+    }
+    return result, nil
+}
+
+func (self *JReader) checkClearResT() (map[string]interface{}, error) {
+    //See checkClearRes - same boundary logic, typed result container.
+    d0 := self.shortestPathDepth()
+    if self.depth() >= d0 - 1 {
+        return nil, nil
+    }
+    path := self.currentPath()
+
+    if len(self.resStateT.result) == 0 {
+        return nil, nil
+    }
+
+    if !self.isFullT() {
+        result := self.resStateT.result
+        seen := self.resStateT.seen
+        self.resStateT = resultContainerT{}
+        self.checkFullT()
+        if self.AllowIncomplete {
+            if self.hasTransforms() {
+                if err := self.finalizeTransformsT(result); err != nil {
+                    return nil, err
+                }
             }
+            return result, nil
         }
-        cmpPathMod += partMod
+        return nil, fmt.Errorf("%w at %s; seen only: %s", ErrIncomplete, path.String(), seen)
     }
 
-    return reqPath == cmpPathMod
+    if len(self.resStateT.skipped) > 0 {
+        self.resStateT = resultContainerT{}
+        self.checkFullT()
+        return nil, fmt.Errorf("%w at %s", ErrOutOfOrder, path.String())
+    }
+
+    self.resStateT = resultContainerT{}
+    self.checkFullT()
+
+    return nil, nil
 }
 
-func (self *JReader) checkFull() bool {
+func (self *JReader) checkFullT() bool {
     foundAllKeys := true
     for _, src := range self.srcPaths() {
         srcSeen := false
-        for _, v := range self.resState.seen {
+        for _, v := range self.resStateT.seen {
             if v.String() == src {
                 srcSeen = true
             }
@@ -532,89 +3261,82 @@ func (self *JReader) checkFull() bool {
             break
         }
     }
-    self.resState.fullState = foundAllKeys
-    return self.isFull()
+    self.resStateT.fullState = foundAllKeys
+    return self.isFullT()
 }
 
-func (self *JReader) isFull() bool {
-    return self.resState.fullState
+func (self *JReader) isFullT() bool {
+    return self.resStateT.fullState
 }
 
-func (self *JReader) reqPath(cmpPath *PathRef) *schemaItem {
-    //Return info about requested path or nothing if path not requested
-    //cmpPath references absolute path like .[0].List[8]
-    for _, schemaItem := range self.schemaItems {
-        //NOTE when comparing absolute vs dynamic path, right/other = dynamic
-        if cmpPath.matches(schemaItem.ReqPath) {
-            return &schemaItem
-        }
+func (self *JReader) setValueT(value interface{}) (map[string]interface{}, error) {
+    path := self.currentPath()
+    req := self.reqPath(path)
+    if req == nil {
+        return nil, nil
     }
-
-    return nil
-}
-//TODO Check for partial match while building path
-
-func (self *JReader) isPathRequested(path *PathRef) bool {
-    return self.reqPath(path) != nil
+    return self.bufferOrCommitT(path, req.DstKey, value, req.ReqPath, req.IsMulti())
 }
 
-func (self *JReader) setValue(value string) map[string]string {
-    //Handle value, update result object...
-
-    //Skip if current element path not on list of requested paths
-    path := self.currentPath()
-    req := self.reqPath(path)
-    if !self.isPathRequested(path) {
-        return nil
+//bufferOrCommitT is the typed counterpart of setValue's predicate-frame
+//check: a value found while its enclosing element is still buffered for
+//a "[?(...)]" predicate is deferred, just like bufferedEmit/commitValue.
+func (self *JReader) bufferOrCommitT(path *PathRef, dstKey string, value interface{}, reqSrc *PathRef, isMulti bool) (map[string]interface{}, error) {
+    if frame := self.topPredicateFrame(); frame != nil {
+        frame.bufferedT = append(frame.bufferedT, bufferedEmitT{path: path, dstKey: dstKey, value: value, reqSrc: reqSrc, isMulti: isMulti})
+        return nil, nil
     }
-    reqSrc := req.ReqPath
-    dstKey := req.DstKey //TODO method
-    isMulti := req.IsMulti()
+    return self.commitValueT(path, dstKey, value, reqSrc, isMulti)
+}
 
-    //Prepare result object, "seen" list for found keys
-    //Remember path to beginning of result object
+//commitValueT is commitValue for ReadTyped/StreamTyped.
+func (self *JReader) commitValueT(path *PathRef, dstKey string, value interface{}, reqSrc *PathRef, isMulti bool) (map[string]interface{}, error) {
     markedSkipped := false
-    resContainer := &self.resState
+    resContainer := &self.resStateT
     if resContainer.result == nil {
-        resContainer.result = make(map[string]string)
-        //resContainer.p0 = path //...
+        resContainer.result = make(map[string]interface{})
     }
     result := resContainer.result
-    //Check for collision (already found), fatal only for absolute path
-    //NOTE we might skip items if collisions are not recognized properly
     if _, ok := result[dstKey]; ok {
         if isMulti {
-            //skip element at: path
             resContainer.skipped = append(resContainer.skipped, path)
             markedSkipped = true
         } else {
-            //Regular req key already found - collision
-            //raise Exception("collision before full at %s (bad order?)", path
-            fmt.Printf("ERROR - collision before full at %s (bad order?)\n", path.String())
-            os.Exit(3)
+            return nil, fmt.Errorf("%w at %s", ErrCollision, path.String())
         }
     }
 
-    //Add value to result object, add path to "seen" list for result
     result[dstKey] = value
     resContainer.seen = append(resContainer.seen, reqSrc)
-    //self.checkFull()
     if len(resContainer.seen) == len(self.srcPaths()) {
-        self.resState.fullState = true
+        self.resStateT.fullState = true
     }
 
-    //Check if result object is complete
-    if self.isFull() {
+    if self.isFullT() {
         if markedSkipped {
             resContainer.skipped = resContainer.skipped[:len(resContainer.skipped)-1]
         }
-        //Yield result
-        return result
-        //NOT clearing and resetting here - there could be more
-        //(more matches with collected values within req area)
-        //see also (for clear/yield): checkClearRes()
+        out := result
+        if isMulti {
+            //See the matching comment in commitValue.
+            out = cloneResultT(result)
+        }
+        if self.hasTransforms() {
+            if err := self.finalizeTransformsT(out); err != nil {
+                return nil, err
+            }
+        }
+        return out, nil
     }
 
-    return nil
+    return nil, nil
 }
 
+//cloneResultT is cloneResultString for the typed result map.
+func cloneResultT(result map[string]interface{}) map[string]interface{} {
+    out := make(map[string]interface{}, len(result))
+    for k, v := range result {
+        out[k] = v
+    }
+    return out
+}
@@ -0,0 +1,291 @@
+package json_extractor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+//TestMultiMatchResultsDontAlias covers the maintainer review finding
+//that each result yielded for a multi-match path (an unindexed array)
+//must be its own map, not a shared reference later overwritten by the
+//next match.
+func TestMultiMatchResultsDontAlias(t *testing.T) {
+	data := `{"List":[{"name":"a"},{"name":"b"},{"name":"c"}]}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{"n": ".List[].name"})
+	resCh, errCh := r.Results()
+	var got []string
+	for res := range resCh {
+		got = append(got, res["n"])
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"a", "b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("got = %#v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d] = %q, want %q (got=%#v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+//TestCaptureSubtreeWithNestedRequest covers chunk0-4's requirement that
+//a capture whole-subtree request (".data") and a separately requested
+//path nested under it (".data.x") can both be satisfied from the same
+//stream position, instead of the nested one being silently dropped.
+func TestCaptureSubtreeWithNestedRequest(t *testing.T) {
+	data := `{"data":{"x":1,"y":2}}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{"obj": ".data", "x": ".data.x"})
+	got, err := r.ReadTyped()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, ok := got["obj"].(map[string]interface{})
+	if !ok || obj["x"] != float64(1) || obj["y"] != float64(2) {
+		t.Errorf("obj = %#v", got["obj"])
+	}
+	if got["x"] != float64(1) {
+		t.Errorf("x = %#v", got["x"])
+	}
+}
+
+//TestContextCancelStopsPromptly covers chunk0-3's promise that
+//cancelling ctx stops the decoder loop promptly: with ctx already
+//cancelled, readCtx returns context.Canceled before reading any token,
+//so the large "big" array ahead of the requested field is never walked.
+//Cancelling in the middle of a skipSubtree/captureSubtree walk is not
+//exercised here.
+func TestContextCancelStopsPromptly(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString(`{"big":[`)
+	for i := 0; i < 500000; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(`{"v":1}`)
+	}
+	sb.WriteString(`],"want":"x"}`)
+
+	r := &JReader{json: json.NewDecoder(strings.NewReader(sb.String()))}
+	r.init()
+	r.SetSchema(map[string]string{"w": ".want"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() //already cancelled before the loop starts
+
+	_, err := r.readCtx(ctx)
+	if err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+//TestPredicateDeferredEmission covers chunk0-2's requirement that a
+//predicate referencing a key which hasn't streamed in yet defers
+//emission until that key is seen, rather than matching (or failing to
+//match) based on an incomplete view of the element.
+func TestPredicateDeferredEmission(t *testing.T) {
+	//"total" (the requested field) arrives before "status" (the
+	//predicate's field) in stream order.
+	data := `{"orders":[
+		{"total":10,"status":"pending"},
+		{"total":20,"status":"paid"}
+	]}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{"total": `.orders[?(@.status=="paid")].total`})
+	got, err := r.Read()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got["total"] != "20" {
+		t.Errorf("got = %#v, want total=20 (the paid order)", got)
+	}
+}
+
+//TestPredicateNested covers chunk0-2's requirement for nested
+//predicates: a predicate-guarded array inside another predicate-guarded
+//array. The matching order is deliberately not the last one streamed,
+//and its items array has more than one qty>1 element, so the test
+//can't pass by accident the way a single-trailing-match fixture would:
+//it only passes if the outer predicate is evaluated at all and every
+//qualifying inner element is flushed, not just the last one.
+func TestPredicateNested(t *testing.T) {
+	data := `{"orders":[
+		{"status":"paid","items":[{"qty":5,"name":"a"},{"qty":1,"name":"b"},{"qty":9,"name":"c"}]},
+		{"status":"pending","items":[{"qty":5,"name":"d"}]}
+	]}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{
+		"name": `.orders[?(@.status=="paid")].items[?(@.qty>1)].name`,
+	})
+	resCh, errCh := r.Results()
+	var got []string
+	for res := range resCh {
+		got = append(got, res["name"])
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"a", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("got = %#v, want %#v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d] = %q, want %q (got=%#v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+//TestReadModeNDJSON covers chunk0-5's ModeNDJSON: each newline-separated
+//top-level document yields its own result independently, instead of
+//stopping after the first one the way the ModeSingleDocument default
+//does.
+func TestReadModeNDJSON(t *testing.T) {
+	data := "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data)), Mode: ModeNDJSON}
+	r.init()
+	r.SetSchema(map[string]string{"n": ".n"})
+	resCh, errCh := r.Results()
+	var got []string
+	for res := range resCh {
+		got = append(got, res["n"])
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"1", "2", "3"}
+	if len(got) != len(want) {
+		t.Fatalf("got = %#v, want %#v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d] = %q, want %q (got=%#v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+//TestSelectFuncSkip covers chunk0-6's SelectFunc hook returning Skip: a
+//subtree is fast-forwarded past without being parsed, overriding the
+//schema-derived default, while a later requested field is still found.
+func TestSelectFuncSkip(t *testing.T) {
+	data := `{"skip":{"a":1,"b":2},"want":"x"}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{"w": ".want"})
+	r.SelectFunc = func(path *PathRef) SelectDecision {
+		//The just-entered level itself isn't identified yet (its key/index
+		//is only known once its first token is read, same as defaultSelect
+		//works around) - so the key that names this subtree is the one
+		//before it.
+		n := len(path.pathL)
+		if n >= 2 && path.pathL[n-2] == "OBJECT" && path.atD[n-2].key == "skip" {
+			return Skip
+		}
+		return Descend
+	}
+	got, err := r.Read()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got["w"] != "x" {
+		t.Errorf("got = %#v, want w=x", got)
+	}
+}
+
+//TestSelectFuncStop covers chunk0-6's SelectFunc hook returning Stop:
+//parsing ends at that point as if the input had ended there, so a
+//requested field appearing only after it is never found.
+func TestSelectFuncStop(t *testing.T) {
+	data := `{"stopHere":{},"never":"seen"}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{"n": ".never"})
+	r.SelectFunc = func(path *PathRef) SelectDecision {
+		n := len(path.pathL)
+		if n >= 2 && path.pathL[n-2] == "OBJECT" && path.atD[n-2].key == "stopHere" {
+			return Stop
+		}
+		return Descend
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("err = %v, want io.EOF - Stop should end input before .never is reached", err)
+	}
+}
+
+//TestTransformPipeAndTernary covers chunk0-7's transform expression
+//language on its happy path: the "| filter" pipe sugar (".name | lower")
+//and a ternary (".price < 10 ? ... : ...") referencing a path directly.
+func TestTransformPipeAndTernary(t *testing.T) {
+	data := `{"name":"BOB","price":9}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{
+		"name":  ".name | lower",
+		"label": `.price < 10 ? "cheap" : "pricey"`,
+	})
+	got, err := r.Read()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got["name"] != "bob" {
+		t.Errorf("name = %#v, want %q", got["name"], "bob")
+	}
+	if got["label"] != "cheap" {
+		t.Errorf("label = %#v, want %q", got["label"], "cheap")
+	}
+}
+
+//TestTransformDivByZero covers chunk0-7's division operator raising an
+//error instead of silently producing Inf/NaN.
+func TestTransformDivByZero(t *testing.T) {
+	data := `{"a":1,"b":0}`
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.SetSchema(map[string]string{"r": ".a / .b"})
+	_, err := r.Read()
+	if err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("err = %v, want a division by zero error", err)
+	}
+}
+
+//TestTransformMissingInputPolicy covers chunk0-7's
+//OnMissingTransformInput: MissingInputError fails the result with
+//ErrMissingInput when one of a transform's input paths was never found,
+//while the default() built-in lets a transform supply its own fallback
+//for the same situation instead.
+func TestTransformMissingInputPolicy(t *testing.T) {
+	data := `{"a":1}`
+
+	r := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r.init()
+	r.OnMissingTransformInput = MissingInputError
+	r.AllowIncomplete = true
+	r.SetSchema(map[string]string{"a": ".a", "r": ".a + .b"})
+	if _, err := r.Read(); !errors.Is(err, ErrMissingInput) {
+		t.Errorf("err = %v, want ErrMissingInput", err)
+	}
+
+	r2 := &JReader{json: json.NewDecoder(strings.NewReader(data))}
+	r2.init()
+	r2.AllowIncomplete = true
+	r2.SetSchema(map[string]string{"a": ".a", "r": `default(.b, "fallback")`})
+	got, err := r2.Read()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got["r"] != "fallback" {
+		t.Errorf("r = %#v, want %q", got["r"], "fallback")
+	}
+}